@@ -7,6 +7,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mibzman/gmitohtml/pkg/gmitohtml"
 	"gopkg.in/yaml.v3"
@@ -19,18 +24,130 @@ type certConfig struct {
 	cert tls.Certificate
 }
 
+type bookmarkConfig struct {
+	URL    string
+	Label  string
+	Folder string   `yaml:",omitempty"`
+	Tags   []string `yaml:",omitempty"`
+}
+
+// bookmarkList is a list of bookmarks. Bookmarks may also be specified as a
+// map of URLs and labels, which is the format used by previous versions.
+type bookmarkList []*bookmarkConfig
+
+func (l *bookmarkList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		var list []*bookmarkConfig
+		err := value.Decode(&list)
+		if err != nil {
+			return err
+		}
+		*l = list
+		return nil
+	}
+
+	list := make([]*bookmarkConfig, 0, len(value.Content)/2)
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		list = append(list, &bookmarkConfig{
+			URL:   value.Content[i].Value,
+			Label: value.Content[i+1].Value,
+		})
+	}
+	*l = list
+	return nil
+}
+
+type tlsConfig struct {
+	Cert       string
+	Key        string
+	SelfSigned bool
+}
+
+type accessConfig struct {
+	AllowHosts []string `yaml:",omitempty"`
+	DenyHosts  []string `yaml:",omitempty"`
+	AllowPorts []int    `yaml:",omitempty"`
+	Public     bool
+}
+
+type authConfig struct {
+	Method         string   `yaml:",omitempty"`
+	PasswordFile   string   `yaml:",omitempty"`
+	Header         string   `yaml:",omitempty"`
+	TrustedProxies []string `yaml:",omitempty"`
+	Admins         []string `yaml:",omitempty"`
+}
+
+type featureConfig struct {
+	AddressBar    bool
+	NavigationBar bool
+	Bookmarks     bool
+	Subscriptions bool
+	Feeds         bool
+
+	CollapsePreformatted bool
+	Highlight            bool
+	HeadingAnchors       bool
+	TableOfContents      int
+	EmbedMedia           bool
+	SniffMedia           bool
+}
+
 type appConfig struct {
-	Bookmarks map[string]string
+	Features featureConfig
+
+	TLS tlsConfig
+
+	Access accessConfig
+
+	Auth authConfig
+
+	AllowedHosts []string `yaml:",omitempty"`
+
+	ContentPolicy string `yaml:",omitempty"`
+	ContentOrigin string `yaml:",omitempty"`
+
+	FileRoots       []string `yaml:",omitempty"`
+	AllowRemoteFile bool
+
+	Bookmarks bookmarkList
+
+	Subscriptions        map[string]string
+	SubscriptionInterval time.Duration
+
+	History      bool
+	HistoryLimit int
 
 	Certs map[string]*certConfig
 }
 
 var config = &appConfig{
-	Bookmarks: make(map[string]string),
+	Subscriptions: make(map[string]string),
 
 	Certs: make(map[string]*certConfig),
 }
 
+var (
+	// configLock protects config and configModTime.
+	configLock sync.Mutex
+
+	// configModTime is the modification time of the configuration file when
+	// it was last read or written.
+	configModTime time.Time
+
+	// applyingProfiles contains the names of the profiles whose
+	// configuration is being applied, with the default profile named "".
+	// Profiles are not saved during this time, as they do not match their
+	// configuration yet. It is protected by configLock.
+	applyingProfiles = make(map[string]bool)
+
+	// pendingSaves contains the names of the profiles which were changed
+	// while their configuration was applied. Changes made concurrently (e.g.
+	// via the web interface) are saved once the configuration is applied. It
+	// is protected by configLock.
+	pendingSaves = make(map[string]bool)
+)
+
 func defaultConfigPath() string {
 	homedir, err := os.UserHomeDir()
 	if err == nil && homedir != "" {
@@ -54,13 +171,231 @@ func readconfig(configPath string) error {
 	if err != nil {
 		return err
 	}
+	if newConfig == nil {
+		newConfig = &appConfig{}
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
 	config = newConfig
+	configModTime = modTime(configPath)
+	return nil
+}
+
+// modTime returns the modification time of a file, or the zero time when
+// the file does not exist.
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// configModified returns whether the configuration file was modified since
+// it was last read, written or checked.
+func configModified(configPath string) bool {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	t := modTime(configPath)
+	if t.IsZero() || t.Equal(configModTime) {
+		return false
+	}
+	configModTime = t
+	return true
+}
+
+// applyConfig applies certificates, bookmarks, subscriptions and history
+// settings to the default profile of the daemon, and reloads the profiles
+// of all users.
+func applyConfig(configPath string, d *gmitohtml.Daemon) error {
+	configLock.Lock()
+	c := config
+	configLock.Unlock()
+
+	d.SetSubscriptionInterval(c.SubscriptionInterval)
+
+	p := d.Profile("")
+	bookmarks := c.Bookmarks
+	if bookmarks == nil {
+		bookmarks = getBookmarks(p)
+	}
+
+	startApplying("")
+	err := applyProfile(p, c.Certs, c.Bookmarks, c.Subscriptions, timelinePath(configPath), knownHostsPath(configPath), c.History, historyPath(configPath), c.HistoryLimit)
+	if finishApplying("") && !profileMatches(p, bookmarks, c.Subscriptions) {
+		saveErr := saveConfig(configPath, d)
+		if err == nil {
+			err = saveErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, name := range d.Profiles() {
+		err := loadProfile(configPath, d.Profile(name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyProfile applies certificates, bookmarks, subscriptions and history
+// settings to a profile, and loads the subscriptions timeline and known
+// hosts. Certificates
+// are loaded before any changes are made, so an invalid certificate leaves
+// the profile unchanged. Bookmarks are only replaced when they are defined,
+// so the default bookmarks are kept when the configuration has none.
+func applyProfile(p *gmitohtml.Profile, certConfigs map[string]*certConfig, bookmarkConfigs bookmarkList, subscriptions map[string]string, timelineFile string, knownHostsFile string, history bool, historyFile string, historyLimit int) error {
+	certs := make(map[string][2][]byte)
+	for domain, cc := range certConfigs {
+		certData, err := ioutil.ReadFile(cc.Cert)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate for domain %s: %s", domain, err)
+		}
+
+		keyData, err := ioutil.ReadFile(cc.Key)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate for domain %s: %s", domain, err)
+		}
+
+		_, err = tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate for domain %s: %s", domain, err)
+		}
+		certs[domain] = [2][]byte{certData, keyData}
+	}
+
+	for _, domain := range p.GetClientCertificateDomains() {
+		if _, ok := certs[domain]; !ok {
+			p.SetClientCertificate(domain, nil, nil)
+		}
+	}
+	for domain, cert := range certs {
+		p.SetClientCertificate(domain, cert[0], cert[1]) // Already validated
+	}
+
+	if bookmarkConfigs != nil {
+		bookmarks := make([]*gmitohtml.Bookmark, len(bookmarkConfigs))
+		for i, b := range bookmarkConfigs {
+			bookmarks[i] = &gmitohtml.Bookmark{
+				URL:    b.URL,
+				Label:  b.Label,
+				Folder: b.Folder,
+				Tags:   b.Tags,
+			}
+		}
+		p.SetBookmarks(bookmarks)
+	}
+
+	for u := range p.GetSubscriptions() {
+		if _, ok := subscriptions[u]; !ok {
+			p.RemoveSubscription(u)
+		}
+	}
+	existing := p.GetSubscriptions()
+	for u, label := range subscriptions {
+		if l, ok := existing[u]; ok && l == label {
+			continue
+		}
+		p.AddSubscription(u, label)
+	}
+
+	err := p.LoadTimeline(timelineFile)
+	if err != nil {
+		return fmt.Errorf("failed to load timeline: %s", err)
+	}
 
+	err = p.LoadKnownHosts(knownHostsFile)
+	if err != nil {
+		return fmt.Errorf("failed to load known hosts: %s", err)
+	}
+
+	if history {
+		err := p.EnableHistory(historyFile, historyLimit)
+		if err != nil {
+			return fmt.Errorf("failed to load history: %s", err)
+		}
+	} else {
+		p.DisableHistory()
+	}
 	return nil
 }
 
-func saveConfig(configPath string) error {
-	config.Bookmarks = gmitohtml.GetBookmarks()
+// startApplying marks the configuration of a profile as being applied.
+func startApplying(name string) {
+	configLock.Lock()
+	applyingProfiles[name] = true
+	configLock.Unlock()
+}
+
+// finishApplying marks the configuration of a profile as applied, and
+// returns whether the profile was changed meanwhile.
+func finishApplying(name string) bool {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	changed := pendingSaves[name]
+	delete(applyingProfiles, name)
+	delete(pendingSaves, name)
+	return changed
+}
+
+// deferSave returns whether saving a profile must be deferred until its
+// configuration is applied. The caller must hold configLock.
+func deferSave(name string) bool {
+	if !applyingProfiles[name] {
+		return false
+	}
+	pendingSaves[name] = true
+	return true
+}
+
+// profileMatches returns whether the bookmarks and subscriptions of a
+// profile match the applied configuration. When they do not, the profile
+// was changed concurrently and must be saved.
+func profileMatches(p *gmitohtml.Profile, bookmarks bookmarkList, subscriptions map[string]string) bool {
+	// Bookmarks are sorted by folder, keeping their order within folders.
+	expected := append(bookmarkList(nil), bookmarks...)
+	sort.SliceStable(expected, func(i, j int) bool {
+		return strings.ToLower(expected[i].Folder) < strings.ToLower(expected[j].Folder)
+	})
+	current := getBookmarks(p)
+	if len(current) != len(expected) {
+		return false
+	}
+	for i, b := range current {
+		if !reflect.DeepEqual(b, expected[i]) {
+			return false
+		}
+	}
+
+	currentSubscriptions := p.GetSubscriptions()
+	if len(currentSubscriptions) != len(subscriptions) {
+		return false
+	}
+	for u, label := range subscriptions {
+		if l, ok := currentSubscriptions[u]; !ok || l != label {
+			return false
+		}
+	}
+	return true
+}
+
+func saveConfig(configPath string, d *gmitohtml.Daemon) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if deferSave("") {
+		return nil
+	}
+
+	config.Bookmarks = getBookmarks(d.Profile(""))
+	config.Subscriptions = d.GetSubscriptions()
 
 	out, err := yaml.Marshal(config)
 	if err != nil {
@@ -73,5 +408,70 @@ func saveConfig(configPath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to save configuration to %s: %s", configPath, err)
 	}
+	configModTime = modTime(configPath)
 	return nil
 }
+
+func historyPath(configPath string) string {
+	if configPath == "" {
+		return ""
+	}
+	return path.Join(path.Dir(configPath), "history.json")
+}
+
+// timelinePath returns the path of the file the subscriptions timeline is
+// saved to.
+func timelinePath(configPath string) string {
+	if configPath == "" {
+		return ""
+	}
+	return path.Join(path.Dir(configPath), "timeline.json")
+}
+
+// knownHostsPath returns the path of the file the server certificates trusted
+// on first use are saved to.
+func knownHostsPath(configPath string) string {
+	if configPath == "" {
+		return ""
+	}
+	return path.Join(path.Dir(configPath), "knownhosts.json")
+}
+
+// passwordPath returns the path of the password file used when no password
+// file is specified.
+func passwordPath(configPath string) string {
+	if configPath == "" {
+		return ""
+	}
+	return path.Join(path.Dir(configPath), "passwords")
+}
+
+// loginKeyPath returns the path of the key login cookies are signed with.
+func loginKeyPath(configPath string) string {
+	if configPath == "" {
+		return ""
+	}
+	return path.Join(path.Dir(configPath), "login.key")
+}
+
+// tlsPaths returns the paths of the certificate and private key generated
+// when serving via HTTPS using a self-signed certificate.
+func tlsPaths(configPath string) (string, string) {
+	if configPath == "" {
+		return "", ""
+	}
+	return path.Join(path.Dir(configPath), "tls.crt"), path.Join(path.Dir(configPath), "tls.key")
+}
+
+func getBookmarks(p *gmitohtml.Profile) bookmarkList {
+	var list bookmarkList
+	for _, b := range p.GetBookmarkEntries() {
+		list = append(list, &bookmarkConfig{
+			URL:    b.URL,
+			Label:  b.Label,
+			Folder: b.Folder,
+			Tags:   b.Tags,
+		})
+	}
+	return list
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mibzman/gmitohtml/pkg/gmitohtml"
+)
+
+// writeConfig writes a configuration file and reads it.
+func writeConfig(t *testing.T, configPath string, data string) {
+	err := ioutil.WriteFile(configPath, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = readconfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadEditedBookmarks(t *testing.T) {
+	configPath := path.Join(t.TempDir(), "config.yaml")
+	options := &gmitohtml.DaemonOptions{Bookmarks: true}
+
+	// All bookmarks were deleted.
+	writeConfig(t, configPath, "bookmarks: []\n")
+	d := gmitohtml.NewDaemon(options)
+	err := applyConfig(configPath, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetOnBookmarksChanged(func() {
+		err := saveConfig(configPath, d)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	if entries := d.GetBookmarkEntries(); len(entries) != 0 {
+		t.Fatalf("expected no bookmarks, got %d", len(entries))
+	}
+
+	writeConfig(t, configPath, `bookmarks:
+  - url: gemini://example.org/
+    label: Example
+  - url: gemini://example.org/log/
+    label: Log
+    folder: Gemlogs
+`)
+	d.Reconfigure(options)
+	err = applyConfig(configPath, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := d.GetBookmarkEntries()
+	if len(entries) != 2 || entries[0].URL != "gemini://example.org/" || entries[1].URL != "gemini://example.org/log/" || entries[1].Folder != "Gemlogs" {
+		t.Errorf("edited bookmarks were not applied: %+v", entries)
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "gemini://example.org/log/") {
+		t.Errorf("edited configuration file was overwritten: %s", data)
+	}
+}
+
+func TestSaveWhileApplying(t *testing.T) {
+	configPath := path.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, configPath, "bookmarks:\n  - url: gemini://example.org/\n    label: Example\n")
+	d := gmitohtml.NewDaemon(&gmitohtml.DaemonOptions{Bookmarks: true})
+	err := applyConfig(configPath, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made while the configuration is applied are saved afterwards.
+	startApplying("")
+	d.AddBookmark("gemini://example.org/new/", "New")
+	err = saveConfig(configPath, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(string(data), "gemini://example.org/new/") {
+		t.Error("configuration was saved while it was applied")
+	}
+	if !finishApplying("") {
+		t.Error("save while applying configuration was not recorded")
+	}
+
+	configLock.Lock()
+	c := config
+	configLock.Unlock()
+	if profileMatches(d.Profile(""), c.Bookmarks, c.Subscriptions) {
+		t.Error("bookmark added while applying configuration was not detected")
+	}
+	if !profileMatches(d.Profile(""), getBookmarks(d.Profile("")), d.GetSubscriptions()) {
+		t.Error("unchanged profile does not match")
+	}
+}
@@ -2,4 +2,9 @@ module github.com/mibzman/gmitohtml
 
 go 1.15
 
-require gopkg.in/yaml.v3 v3.0.0-20210105161348-2e78108cf5f8
+require (
+	github.com/alecthomas/chroma v0.10.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/text v0.13.0
+	gopkg.in/yaml.v3 v3.0.0-20210105161348-2e78108cf5f8
+)
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,10 +12,24 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/mibzman/gmitohtml/pkg/gmitohtml"
 )
 
+// stringList is a flag which may be specified multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func openBrowser(url string) {
 	var err error
 	switch runtime.GOOS {
@@ -30,6 +47,61 @@ func openBrowser(url string) {
 	}
 }
 
+// convertFeed converts a gemlog index page to an Atom feed. The page is read
+// from the specified file, or from stdin when no file is specified. The URL
+// of the page is required, as it identifies the feed.
+func convertFeed(file string, pageURL string) error {
+	if pageURL == "" {
+		return fmt.Errorf("usage: gmitohtml --url=<URL of page> feed [file]")
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if file != "" && file != "-" {
+		data, err = ioutil.ReadFile(file)
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	out, err := gmitohtml.ParseFeed(data, pageURL).Atom()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// setPassword sets the password of a user in the password file. The
+// password is read from stdin.
+func setPassword(configPath string, name string) error {
+	if name == "" {
+		return fmt.Errorf("usage: gmitohtml passwd <user>")
+	}
+
+	configLock.Lock()
+	passwordFile := config.Auth.PasswordFile
+	configLock.Unlock()
+	if passwordFile == "" {
+		passwordFile = passwordPath(configPath)
+	}
+	if passwordFile == "" {
+		return fmt.Errorf("no password file specified")
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	return gmitohtml.SetPassword(passwordFile, name, strings.TrimRight(password, "\r\n"))
+}
+
 func main() {
 	var (
 		view       bool
@@ -37,12 +109,61 @@ func main() {
 		daemon     string
 		hostname   string
 		configFile string
+		pageURL    string
+		charset    string
+		lang       string
+		title      string
+
+		addressBar    bool
+		navigationBar bool
+		bookmarks     bool
+		subscriptions bool
+		feeds         bool
+
+		collapsePreformatted bool
+		highlight            bool
+		headingAnchors       bool
+		tableOfContents      int
+		embedMedia           bool
+		sniffMedia           bool
+
+		watchConfig bool
+		public      bool
+
+		fileRoots       stringList
+		allowRemoteFile bool
+
+		tlsCert       string
+		tlsKey        string
+		tlsSelfSigned bool
 	)
 	flag.BoolVar(&view, "view", false, "open web browser")
 	flag.BoolVar(&allowFile, "allow-file", false, "allow local file access via file://")
-	flag.StringVar(&daemon, "daemon", "", "start daemon on specified address")
-	flag.StringVar(&hostname, "hostname", "", "server hostname (e.g. rocketnine.space) (defaults to daemon address)")
+	flag.Var(&fileRoots, "file-root", "directory local files may be accessed in (may be specified multiple times) (defaults to current directory)")
+	flag.BoolVar(&allowRemoteFile, "allow-remote-file", false, "allow local file access by clients on other machines")
+	flag.StringVar(&daemon, "daemon", "", "start daemon on specified address (unix:/path/to/socket for a Unix domain socket, systemd for socket activation)")
+	flag.StringVar(&hostname, "hostname", "", "server hostname (e.g. rocketnine.space) (defaults to localhost)")
 	flag.StringVar(&configFile, "config", "", "path to configuration file")
+	flag.StringVar(&pageURL, "url", "", "URL of the converted document (used to resolve relative links)")
+	flag.StringVar(&charset, "charset", "", "character encoding of the converted document (defaults to UTF-8)")
+	flag.StringVar(&lang, "lang", "", "language of the converted document (e.g. fr)")
+	flag.StringVar(&title, "title", "", "title of the converted document (defaults to the first heading)")
+	flag.BoolVar(&addressBar, "address-bar", false, "show address bar")
+	flag.BoolVar(&navigationBar, "navigation-bar", false, "show navigation bar")
+	flag.BoolVar(&bookmarks, "bookmarks", false, "enable bookmarks")
+	flag.BoolVar(&subscriptions, "subscriptions", false, "enable subscriptions")
+	flag.BoolVar(&feeds, "feeds", false, "serve feeds of gemlogs")
+	flag.BoolVar(&collapsePreformatted, "collapse-preformatted", false, "collapse preformatted text")
+	flag.BoolVar(&highlight, "highlight", false, "highlight syntax of preformatted text labeled with a language")
+	flag.BoolVar(&headingAnchors, "heading-anchors", false, "add links to headings")
+	flag.IntVar(&tableOfContents, "toc", 0, "insert a table of contents in pages with more than the specified number of headings")
+	flag.BoolVar(&embedMedia, "embed-media", false, "embed linked images, audio and video")
+	flag.BoolVar(&sniffMedia, "sniff-media", false, "embed links by the type of content fetched by the daemon rather than by file extension")
+	flag.StringVar(&tlsCert, "tls-cert", "", "serve via HTTPS using specified certificate")
+	flag.StringVar(&tlsKey, "tls-key", "", "serve via HTTPS using specified private key")
+	flag.BoolVar(&tlsSelfSigned, "tls-self-signed", false, "serve via HTTPS using a self-signed certificate")
+	flag.BoolVar(&public, "public", false, "deny connecting to loopback and private addresses")
+	flag.BoolVar(&watchConfig, "watch-config", false, "reload configuration file when it is modified")
 	// TODO option to include response header in page
 	flag.Parse()
 
@@ -62,62 +183,245 @@ func main() {
 			if err != nil {
 				log.Fatalf("failed to read configuration file at %s: %v\nSee CONFIGURATION.md for information on configuring gmitohtml", configFile, err)
 			}
+		}
+	}
+
+	if daemon != "" {
+		daemonOptions := func() *gmitohtml.DaemonOptions {
+			configLock.Lock()
+			features := config.Features
+			tlsOptions := config.TLS
+			access := config.Access
+			roots := config.FileRoots
+			remoteFile := config.AllowRemoteFile
+			allowedHosts := config.AllowedHosts
+			auth := config.Auth
+			history := config.History
+			contentPolicy, contentOrigin := config.ContentPolicy, config.ContentOrigin
+			configLock.Unlock()
 
-			for u, label := range config.Bookmarks {
-				gmitohtml.AddBookmark(u, label)
+			// Command line arguments take precedence over the configuration file.
+			flag.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "address-bar":
+					features.AddressBar = addressBar
+				case "navigation-bar":
+					features.NavigationBar = navigationBar
+				case "bookmarks":
+					features.Bookmarks = bookmarks
+				case "subscriptions":
+					features.Subscriptions = subscriptions
+				case "feeds":
+					features.Feeds = feeds
+				case "collapse-preformatted":
+					features.CollapsePreformatted = collapsePreformatted
+				case "highlight":
+					features.Highlight = highlight
+				case "heading-anchors":
+					features.HeadingAnchors = headingAnchors
+				case "toc":
+					features.TableOfContents = tableOfContents
+				case "embed-media":
+					features.EmbedMedia = embedMedia
+				case "sniff-media":
+					features.SniffMedia = sniffMedia
+				case "tls-cert":
+					tlsOptions.Cert = tlsCert
+				case "tls-key":
+					tlsOptions.Key = tlsKey
+				case "tls-self-signed":
+					tlsOptions.SelfSigned = tlsSelfSigned
+				case "public":
+					access.Public = public
+				case "file-root":
+					roots = fileRoots
+				case "allow-remote-file":
+					remoteFile = allowRemoteFile
+				}
+			})
+
+			if tlsOptions.SelfSigned && tlsOptions.Cert == "" && tlsOptions.Key == "" {
+				tlsOptions.Cert, tlsOptions.Key = tlsPaths(configFile)
+			}
+			var loginKeyFile string
+			if auth.Method == gmitohtml.AuthenticationPassword {
+				if auth.PasswordFile == "" {
+					auth.PasswordFile = passwordPath(configFile)
+				}
+				loginKeyFile = loginKeyPath(configFile)
+			}
+
+			return &gmitohtml.DaemonOptions{
+				Address:         daemon,
+				Hostname:        hostname,
+				AllowFile:       allowFile,
+				FileRoots:       roots,
+				AllowRemoteFile: remoteFile,
+				AddressBar:      features.AddressBar,
+				NavigationBar:   features.NavigationBar,
+				Bookmarks:       features.Bookmarks,
+				Subscriptions:   features.Subscriptions,
+				History:         history,
+				Feeds:           features.Feeds,
+				CertFile:        tlsOptions.Cert,
+				KeyFile:         tlsOptions.Key,
+				SelfSigned:      tlsOptions.SelfSigned,
+				AllowedHosts:    allowedHosts,
+				ContentPolicy:   contentPolicy,
+				ContentOrigin:   contentOrigin,
+				Authentication:  auth.Method,
+				PasswordFile:    auth.PasswordFile,
+				LoginKeyFile:    loginKeyFile,
+				UserHeader:      auth.Header,
+				TrustedProxies:  auth.TrustedProxies,
+				Admins:          auth.Admins,
+				Access: gmitohtml.AccessPolicy{
+					AllowHosts: access.AllowHosts,
+					DenyHosts:  access.DenyHosts,
+					AllowPorts: access.AllowPorts,
+					Public:     access.Public,
+				},
+				CollapsePreformatted: features.CollapsePreformatted,
+				Highlight:            features.Highlight,
+				HeadingAnchors:       features.HeadingAnchors,
+				TableOfContents:      features.TableOfContents,
+				EmbedMedia:           features.EmbedMedia,
+				SniffMedia:           features.SniffMedia,
 			}
 		}
-	}
 
-	for domain, cc := range config.Certs {
-		certData, err := ioutil.ReadFile(cc.Cert)
-		if err != nil {
-			log.Fatalf("failed to load client certificate for domain %s: %s", domain, err)
+		options := daemonOptions()
+		switch options.Authentication {
+		case "", gmitohtml.AuthenticationPassword, gmitohtml.AuthenticationHeader:
+		default:
+			log.Fatalf("unknown authentication method: %s", options.Authentication)
 		}
 
-		keyData, err := ioutil.ReadFile(cc.Key)
+		d := gmitohtml.NewDaemon(options)
+
+		err := applyConfig(configFile, d)
 		if err != nil {
-			log.Fatalf("failed to load client certificate for domain %s: %s", domain, err)
+			log.Fatal(err)
 		}
 
-		err = gmitohtml.SetClientCertificate(domain, certData, keyData)
-		if err != nil {
-			log.Fatalf("failed to load client certificate for domain %s", domain)
+		setupProfiles(configFile, d)
+		if options.Authentication != "" {
+			loadProfiles(configFile, d)
 		}
-	}
 
-	if daemon != "" {
-		gmitohtml.SetOnBookmarksChanged(func() {
-			config.Bookmarks = gmitohtml.GetBookmarks()
+		d.SetOnBookmarksChanged(func() {
+			err := saveConfig(configFile, d)
+			if err != nil {
+				log.Fatal(err)
+			}
+		})
 
-			err := saveConfig(configFile)
+		d.SetOnSubscriptionsChanged(func() {
+			err := saveConfig(configFile, d)
 			if err != nil {
 				log.Fatal(err)
 			}
 		})
 
-		err := gmitohtml.StartDaemon(daemon, hostname, allowFile)
+		err = d.Start()
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		if view {
-			openBrowser("http://" + daemon)
+			daemonURL := d.URL()
+			if daemonURL == "" {
+				log.Printf("not opening web browser: address of %s is unknown", daemon)
+			} else {
+				openBrowser(daemonURL)
+			}
 		}
 
-		select {}
+		var reloadLock sync.Mutex
+		reload := func() {
+			reloadLock.Lock()
+			defer reloadLock.Unlock()
+
+			err := readconfig(configFile)
+			if err != nil {
+				log.Printf("failed to reload configuration file at %s: %s", configFile, err)
+				return
+			}
+
+			d.Reconfigure(daemonOptions())
+
+			err = applyConfig(configFile, d)
+			if err != nil {
+				log.Printf("failed to reload configuration file at %s: %s", configFile, err)
+				return
+			}
+			log.Printf("reloaded configuration file at %s", configFile)
+		}
+
+		if watchConfig {
+			go watchConfigFile(configFile, reload)
+		}
+
+		handleSignals(reload, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+
+			err := d.Shutdown(ctx)
+			if err != nil {
+				log.Printf("failed to shut down gracefully: %s", err)
+			}
+
+			if _, err := os.Stat(configFile); err == nil {
+				err = saveConfig(configFile, d)
+				if err != nil {
+					log.Print(err)
+				}
+			}
+		})
+		return
 	}
 
-	data, err := ioutil.ReadAll(os.Stdin)
-	if err != nil {
-		log.Fatal(err)
+	if flag.Arg(0) == "passwd" {
+		err := setPassword(configFile, flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "feed" {
+		err := convertFeed(flag.Arg(1), pageURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	data = gmitohtml.Convert(data, "")
+	convertOptions := &gmitohtml.ConvertOptions{
+		URL:     pageURL,
+		Charset: charset,
+		Lang:    lang,
+		Title:   title,
+
+		CollapsePreformatted: collapsePreformatted,
+		Highlight:            highlight,
+		HeadingAnchors:       headingAnchors,
+		TableOfContents:      tableOfContents,
+		EmbedMedia:           embedMedia,
+	}
 
 	if view {
-		openBrowser(string(append([]byte("data:text/html,"), []byte(url.PathEscape(string(data)))...)))
+		var b bytes.Buffer
+		err := gmitohtml.ConvertStream(&b, os.Stdin, convertOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		openBrowser("data:text/html," + url.PathEscape(b.String()))
 		return
 	}
-	fmt.Print(gmitohtml.Convert(data, ""))
+
+	err := gmitohtml.ConvertStream(os.Stdout, os.Stdin, convertOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,213 @@
+package gmitohtml
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultGeminiPort is the port Gemini servers listen on by default.
+const DefaultGeminiPort = 1965
+
+// ErrAccessDenied is the error returned when the access policy does not allow
+// connecting to a server.
+var ErrAccessDenied = errors.New("access denied")
+
+// AccessPolicy restricts the servers the daemon connects to. Hosts are
+// specified as hostnames (e.g. example.org), wildcard hostnames matching all
+// subdomains (e.g. *.example.org), IP addresses or CIDR ranges (e.g.
+// 10.0.0.0/8).
+type AccessPolicy struct {
+	// AllowHosts are the hosts the daemon may connect to. When empty, all
+	// hosts not denied are allowed.
+	AllowHosts []string
+
+	// DenyHosts are the hosts the daemon may not connect to. DenyHosts takes
+	// precedence over AllowHosts.
+	DenyHosts []string
+
+	// AllowPorts are the ports the daemon may connect to. When empty, all
+	// ports are allowed, or only the default Gemini port in public mode.
+	AllowPorts []int
+
+	// Public denies connecting to loopback, private, link-local and other
+	// non-public addresses, unless their IP address or range is explicitly
+	// listed in AllowHosts. This should be enabled when the daemon is
+	// reachable by untrusted clients.
+	Public bool
+}
+
+// nonPublicNetworks are the networks denied in public mode.
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96", // NAT64, which may reach IPv4 private addresses
+	"2002::/16",    // 6to4, which may reach IPv4 private addresses
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// matchHost returns whether a hostname or IP address matches a host
+// specified in an access policy.
+func matchHost(pattern string, host string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if ip := net.ParseIP(host); ip != nil {
+		return matchIP(pattern, ip)
+	}
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == strings.TrimSuffix(pattern, ".")
+}
+
+// matchIP returns whether an IP address matches an IP address or CIDR range
+// specified in an access policy. Hostnames never match.
+func matchIP(pattern string, ip net.IP) bool {
+	pattern = strings.TrimSpace(pattern)
+	if strings.ContainsRune(pattern, '/') {
+		_, network, err := net.ParseCIDR(pattern)
+		return err == nil && network.Contains(ip)
+	}
+	patternIP := net.ParseIP(pattern)
+	return patternIP != nil && patternIP.Equal(ip)
+}
+
+// checkHost returns an error when the access policy does not allow
+// connecting to a host and port. The host may be a hostname or IP address.
+func (p *AccessPolicy) checkHost(host string, port int) error {
+	allowedPort := len(p.AllowPorts) == 0 && (!p.Public || port == DefaultGeminiPort)
+	for _, allowed := range p.AllowPorts {
+		if port == allowed {
+			allowedPort = true
+			break
+		}
+	}
+	if !allowedPort {
+		return fmt.Errorf("%w: port %d is not allowed", ErrAccessDenied, port)
+	}
+
+	for _, denied := range p.DenyHosts {
+		if matchHost(denied, host) {
+			return fmt.Errorf("%w: %s is not allowed", ErrAccessDenied, host)
+		}
+	}
+
+	if len(p.AllowHosts) > 0 {
+		var allowed bool
+		for _, pattern := range p.AllowHosts {
+			if matchHost(pattern, host) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s is not allowed", ErrAccessDenied, host)
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+// checkIP returns an error when the access policy does not allow connecting
+// to an IP address. Hostnames are resolved before connecting, so IP addresses
+// are checked again when connecting.
+func (p *AccessPolicy) checkIP(ip net.IP) error {
+	for _, denied := range p.DenyHosts {
+		if matchIP(denied, ip) {
+			return fmt.Errorf("%w: %s is not allowed", ErrAccessDenied, ip)
+		}
+	}
+
+	if !p.Public {
+		return nil
+	}
+
+	for _, allowed := range p.AllowHosts {
+		if matchIP(allowed, ip) {
+			return nil
+		}
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("%w: %s is not a public address", ErrAccessDenied, ip)
+		}
+	}
+	return nil
+}
+
+// dialControl checks the address being connected to, after hostnames have
+// been resolved. This prevents connecting to denied addresses via DNS.
+func (p *AccessPolicy) dialControl(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: failed to parse address %s", ErrAccessDenied, address)
+	}
+	return p.checkIP(ip)
+}
+
+// splitHostPort splits a host into a hostname and port. The default Gemini
+// port is used when no port is specified.
+func splitHostPort(host string) (string, int, error) {
+	hostname, portValue, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, portValue = strings.Trim(host, "[]"), strconv.Itoa(DefaultGeminiPort)
+	}
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port: %s", portValue)
+	}
+	return hostname, port, nil
+}
+
+// writeAccessDenied writes a page explaining why a request was refused.
+func (d *Daemon) writeAccessDenied(writer http.ResponseWriter, request *http.Request, u string, err error) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(http.StatusForbidden)
+
+	writer.Write(d.renderPage(accessDeniedTemplate, d.requestProfile(request), u, false, "", &struct {
+		URL   string
+		Error string
+	}{
+		URL:   u,
+		Error: err.Error(),
+	}))
+}
@@ -0,0 +1,165 @@
+package gmitohtml
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{"example.org", "example.org", true},
+		{"Example.org.", "EXAMPLE.ORG.", true},
+		{"example.org", "www.example.org", false},
+		{"example.org", "example.com", false},
+		{"*.example.org", "www.example.org", true},
+		{"*.example.org", "a.b.example.org", true},
+		{"*.example.org", "example.org", false},
+		{"*.example.org", "badexample.org", false},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.0.0.1", false},
+		{"10.0.0.0/8", "example.org", false},
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.2", false},
+		{"::1", "::1", true},
+		{"fc00::/7", "fd00::1", true},
+		{"example.org", "10.0.0.1", false},
+		{"*.example.org", "10.0.0.1", false},
+	}
+	for _, test := range tests {
+		if match := matchHost(test.pattern, test.host); match != test.match {
+			t.Errorf("matchHost(%q, %q) = %v, expected %v", test.pattern, test.host, match, test.match)
+		}
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	public := AccessPolicy{Public: true}
+	tests := []struct {
+		policy AccessPolicy
+		host   string
+		port   int
+		denied bool
+	}{
+		{AccessPolicy{}, "example.org", 1965, false},
+		{AccessPolicy{}, "example.org", 8080, false},
+		{AccessPolicy{}, "127.0.0.1", 1965, false},
+		{AccessPolicy{}, "10.0.0.1", 1965, false},
+
+		// Ports
+		{public, "example.org", 8080, true},
+		{public, "example.org", 1965, false},
+		{AccessPolicy{AllowPorts: []int{1965, 1966}}, "example.org", 1966, false},
+		{AccessPolicy{AllowPorts: []int{1965, 1966}}, "example.org", 8080, true},
+		{AccessPolicy{Public: true, AllowPorts: []int{8080}}, "example.org", 8080, false},
+
+		// Loopback and private addresses
+		{public, "93.184.216.34", 1965, false},
+		{public, "2606:4700::1", 1965, false},
+		{public, "127.0.0.1", 1965, true},
+		{public, "127.1.2.3", 1965, true},
+		{public, "0.0.0.0", 1965, true},
+		{public, "10.1.2.3", 1965, true},
+		{public, "172.16.0.1", 1965, true},
+		{public, "192.168.1.1", 1965, true},
+		{public, "169.254.169.254", 1965, true},
+		{public, "100.64.0.1", 1965, true},
+		{public, "::", 1965, true},
+		{public, "::1", 1965, true},
+		{public, "::ffff:127.0.0.1", 1965, true},
+		{public, "fd00::1", 1965, true},
+		{public, "fe80::1", 1965, true},
+		{public, "64:ff9b::a00:1", 1965, true},
+		{public, "2002:a00:1::1", 1965, true},
+		{AccessPolicy{Public: true, AllowHosts: []string{"10.0.0.0/8"}}, "10.1.2.3", 1965, false},
+		{AccessPolicy{Public: true, AllowHosts: []string{"10.0.0.0/8"}}, "192.168.1.1", 1965, true},
+
+		// Allowed and denied hosts
+		{AccessPolicy{AllowHosts: []string{"example.org"}}, "example.org", 1965, false},
+		{AccessPolicy{AllowHosts: []string{"example.org"}}, "example.com", 1965, true},
+		{AccessPolicy{AllowHosts: []string{"*.example.org"}}, "gemini.example.org", 1965, false},
+		{AccessPolicy{DenyHosts: []string{"*.example.org"}}, "gemini.example.org", 1965, true},
+		{AccessPolicy{DenyHosts: []string{"*.example.org"}}, "example.org", 1965, false},
+		{AccessPolicy{DenyHosts: []string{"192.0.2.0/24"}}, "192.0.2.1", 1965, true},
+		{AccessPolicy{AllowHosts: []string{"10.0.0.0/8"}, DenyHosts: []string{"10.0.0.0/8"}}, "10.0.0.1", 1965, true},
+	}
+	for _, test := range tests {
+		err := test.policy.checkHost(test.host, test.port)
+		if test.denied && !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("%+v: expected %s port %d to be denied, got %v", test.policy, test.host, test.port, err)
+		} else if !test.denied && err != nil {
+			t.Errorf("%+v: expected %s port %d to be allowed, got %s", test.policy, test.host, test.port, err)
+		}
+	}
+}
+
+func TestDialControl(t *testing.T) {
+	public := AccessPolicy{Public: true}
+	tests := []struct {
+		policy  AccessPolicy
+		address string
+		denied  bool
+	}{
+		{AccessPolicy{}, "127.0.0.1:1965", false},
+		{public, "93.184.216.34:1965", false},
+		{public, "127.0.0.1:1965", true},
+		{public, "[::1]:1965", true},
+		{public, "10.0.0.1:1965", true},
+		{public, "[64:ff9b::a00:1]:1965", true},
+		{AccessPolicy{Public: true, AllowHosts: []string{"127.0.0.1"}}, "127.0.0.1:1965", false},
+		{AccessPolicy{DenyHosts: []string{"192.0.2.0/24"}}, "192.0.2.1:1965", true},
+		{AccessPolicy{}, "example.org:1965", true},
+	}
+	for _, test := range tests {
+		err := test.policy.dialControl("tcp", test.address, nil)
+		if test.denied && err == nil {
+			t.Errorf("%+v: expected %s to be denied", test.policy, test.address)
+		} else if !test.denied && err != nil {
+			t.Errorf("%+v: expected %s to be allowed, got %s", test.policy, test.address, err)
+		}
+	}
+
+	if err := public.dialControl("tcp", "invalid", nil); err == nil {
+		t.Error("expected error for invalid address")
+	}
+}
+
+func TestFetchResolvedAddressDenied(t *testing.T) {
+	address := testGeminiServer(t, staticResponse("20 text/gemini\r\n# Page\n"))
+	_, portValue, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portValue)
+	u := "gemini://localhost:" + portValue + "/"
+
+	d := NewDaemon(&DaemonOptions{Access: AccessPolicy{AllowPorts: []int{port}}})
+	_, _, body, err := d.fetchResponse(d.profile, u)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	body.Close()
+
+	// localhost is only denied after it is resolved to a loopback address.
+	d = NewDaemon(&DaemonOptions{Access: AccessPolicy{Public: true, AllowPorts: []int{port}}})
+	_, _, _, err = d.fetchResponse(d.profile, u)
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("expected connecting to loopback address to be denied, got %v", err)
+	}
+}
+
+func TestDefaultHostname(t *testing.T) {
+	d := NewDaemon(&DaemonOptions{Access: AccessPolicy{DenyHosts: []string{"localhost"}}})
+
+	w := serve(d, "GET", "/page.gmi", nil, nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "gemini://localhost/page.gmi") {
+		t.Errorf("expected page to be requested from localhost, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -2,47 +2,6 @@ package gmitohtml
 
 var fs = make(inMemoryFS)
 
-const pageHeader = `
-<!DOCTYPE html>
-<html>
-<head>
-<meta name="viewport" content="width=device-width,initial-scale=1">
-<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/water.css@2/out/water.css">
-</head>
-<body>`
-
-const navHeader = `
-<div>
-<form method="post" action="/" novalidate>
-<input type="url" name="address" id="navigationaddress" placeholder="Address" size="40" value="~GEMINICURRENTURL~" autocomplete="off" autocorrect="off" autocapitalize="off" spellcheck="false" ~GEMINIAUTOFOCUS~>
-</form>
-<div id="navigationbar">
-<a href="/bookmarks" class="navlink">View bookmarks</a> &nbsp;-&nbsp; <a href="/bookmarks?add=~GEMINICURRENTURL~" class="navlink">Add bookmark</a>
-</div>
-</div>
-`
-
-const contentHeader = `
-<div id="content">
-`
-
-const inputPrompt = `
-<form method="post" action="~GEMINIINPUTFORM~">
-<div style="padding-top: 25px;">
-<span style="font-size: 1.5em;">~GEMINIINPUTPROMPT~</span><br><br>
-<div>
-<input type="~GEMINIINPUTTYPE~" name="input" placeholder="Input" size="40" autocomplete="off" autocorrect="off" autocapitalize="off" spellcheck="false" autofocus>
-</div>
-</div>
-</form>
-`
-
-const pageFooter = `
-</div>
-</body>
-</html>
-`
-
 // StyleCSS specifies page styling.
 const StyleCSS = `
 /*! normalize.css v8.0.1 | MIT License | github.com/necolas/normalize.css */
@@ -492,4 +451,5 @@ template {
 
 func loadAssets() {
 	fs["/assets/style.css"] = loadFile("style.css", StyleCSS, fs)
+	fs["/assets/highlight.css"] = loadFile("highlight.css", HighlightCSS(), fs)
 }
@@ -0,0 +1,702 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Methods of authenticating users. When authentication is enabled, each
+// user has a separate profile.
+const (
+	// AuthenticationPassword authenticates users via a password, which is
+	// verified against the bcrypt hash in DaemonOptions.PasswordFile.
+	AuthenticationPassword = "password"
+
+	// AuthenticationHeader trusts the user name provided by a reverse proxy
+	// in DaemonOptions.UserHeader.
+	AuthenticationHeader = "header"
+)
+
+// DefaultUserHeader is the header the user name is read from when
+// authenticating via AuthenticationHeader and no header is specified.
+const DefaultUserHeader = "X-Forwarded-User"
+
+// loginCookie is the name of the cookie identifying a signed in user.
+const loginCookie = "gmitohtml_user"
+
+// loginDuration is the time users stay signed in.
+const loginDuration = 30 * 24 * time.Hour
+
+// loginKeySize is the size of the key login cookies are signed with.
+const loginKeySize = 32
+
+const (
+	// maxLoginFailures is the number of failed sign in attempts allowed for
+	// each user and client address within loginFailureWindow. Further
+	// attempts are refused until the window has passed.
+	maxLoginFailures = 5
+
+	// loginFailureWindow is the time failed sign in attempts are counted.
+	loginFailureWindow = 15 * time.Minute
+
+	// maxLoginLimits is the maximum number of users and client addresses
+	// failed sign in attempts are counted for.
+	maxLoginLimits = 10000
+)
+
+// ErrInvalidUserName is the error returned when a user name contains
+// characters other than letters, digits and . _ @ -, or is too long.
+var ErrInvalidUserName = errors.New("invalid user name")
+
+// ErrNotAuthenticated is the error returned when a request is not
+// authenticated.
+var ErrNotAuthenticated = errors.New("not authenticated")
+
+var (
+	// dummyHash is compared against when a user does not exist, so that
+	// signing in takes the same time whether a user exists or not.
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// validUserName returns whether a user name may be used. User names are
+// also used as file names.
+func validUserName(name string) bool {
+	if name == "" || len(name) > 64 || name[0] == '.' {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._@-", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAdmin returns whether a user may manage users.
+func (o *DaemonOptions) isAdmin(name string) bool {
+	for _, admin := range o.Admins {
+		if admin == name {
+			return true
+		}
+	}
+	return false
+}
+
+// userStore caches the password file. The file is read again when it is
+// modified.
+type userStore struct {
+	file    string
+	modTime time.Time
+	size    int64
+	hashes  map[string][]byte
+	sync.Mutex
+}
+
+func newUserStore() *userStore {
+	return &userStore{}
+}
+
+// load reads the password file unless it is unchanged since it was last
+// read. The caller must hold the lock.
+func (s *userStore) load(file string) {
+	info, err := os.Stat(file)
+	if err == nil && file == s.file && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return
+	}
+
+	s.file = file
+	s.modTime, s.size = time.Time{}, 0
+	s.hashes = nil
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("failed to read password file %s: %s", file, err)
+		}
+		return
+	}
+
+	hashes, err := readPasswordFile(file)
+	if err != nil {
+		log.Printf("failed to read password file %s: %s", file, err)
+		return
+	}
+	s.modTime, s.size = info.ModTime(), info.Size()
+	s.hashes = hashes
+}
+
+// loginFailures counts the failed sign in attempts of a user or client.
+type loginFailures struct {
+	count int
+	start time.Time
+}
+
+// loginLimiter limits failed sign in attempts, which slows down guessing
+// passwords. Attempts are counted both for each user and for each client
+// address, identified by keys.
+type loginLimiter struct {
+	failures map[string]*loginFailures
+	sync.Mutex
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		failures: make(map[string]*loginFailures),
+	}
+}
+
+// blocked returns whether too many failed sign in attempts were counted for
+// any of the keys.
+func (l *loginLimiter) blocked(keys ...string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if !ok {
+			continue
+		} else if now.Sub(f.start) >= loginFailureWindow {
+			delete(l.failures, key)
+			continue
+		}
+		if f.count >= maxLoginFailures {
+			return true
+		}
+	}
+	return false
+}
+
+// fail counts a failed sign in attempt for each key.
+func (l *loginLimiter) fail(keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if len(l.failures)+len(keys) > maxLoginLimits {
+		for key, f := range l.failures {
+			if now.Sub(f.start) >= loginFailureWindow {
+				delete(l.failures, key)
+			}
+		}
+		if len(l.failures)+len(keys) > maxLoginLimits {
+			l.failures = make(map[string]*loginFailures)
+		}
+	}
+
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if !ok || now.Sub(f.start) >= loginFailureWindow {
+			f = &loginFailures{start: now}
+			l.failures[key] = f
+		}
+		f.count++
+	}
+}
+
+// reset removes the failed sign in attempts counted for each key.
+func (l *loginLimiter) reset(keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+// clientAddress returns the IP address of the client a request was sent by.
+// The address provided by a trusted reverse proxy is used when available.
+func (o *DaemonOptions) clientAddress(request *http.Request) string {
+	if o.trustedProxy(request) {
+		if client, ok := forwardedClient(request.Header); ok && client != "" {
+			return client
+		}
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// hash returns the password hash of a user.
+func (s *userStore) hash(file string, name string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.load(file)
+	hash, ok := s.hashes[name]
+	return hash, ok
+}
+
+// names returns the names of all users.
+func (s *userStore) names(file string) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	s.load(file)
+	names := make([]string, 0, len(s.hashes))
+	for name := range s.hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readPasswordFile reads user names and bcrypt password hashes from a file
+// containing one name:hash pair per line, as created by htpasswd -B.
+func readPasswordFile(file string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string][]byte)
+	scanner := newLineScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 || !validUserName(split[0]) {
+			continue
+		}
+		hashes[split[0]] = []byte(split[1])
+	}
+	return hashes, scanner.Err()
+}
+
+// writePasswordFile replaces the contents of a password file.
+func writePasswordFile(file string, hashes map[string][]byte) error {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s:%s\n", name, hashes[name])
+	}
+
+	os.MkdirAll(filepath.Dir(file), 0755) // Ignore error
+
+	// Replace the file at once, so it is never read partially written.
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return fmt.Errorf("failed to save password file %s: %s", file, err)
+	}
+	_, err = tmp.Write(b.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save password file %s: %s", file, err)
+	}
+	return nil
+}
+
+// SetPassword sets the password of a user in a password file, adding the
+// user when necessary. The file is created when it does not exist.
+func SetPassword(file string, name string, password string) error {
+	if !validUserName(name) {
+		return ErrInvalidUserName
+	} else if password == "" {
+		return errors.New("empty password")
+	}
+
+	hashes, err := readPasswordFile(file)
+	if os.IsNotExist(err) {
+		hashes = make(map[string][]byte)
+	} else if err != nil {
+		return fmt.Errorf("failed to read password file %s: %s", file, err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %s", err)
+	}
+	hashes[name] = hash
+	return writePasswordFile(file, hashes)
+}
+
+// RemoveUser removes a user from a password file.
+func RemoveUser(file string, name string) error {
+	hashes, err := readPasswordFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read password file %s: %s", file, err)
+	}
+	if _, ok := hashes[name]; !ok {
+		return nil
+	}
+	delete(hashes, name)
+	return writePasswordFile(file, hashes)
+}
+
+// loadLoginKey reads the key login cookies are signed with from a file. When
+// the file does not exist, a random key is generated and saved to it.
+func loadLoginKey(file string) ([]byte, error) {
+	key, err := ioutil.ReadFile(file)
+	if err == nil {
+		if len(key) < loginKeySize {
+			return nil, fmt.Errorf("login key %s is too short", file)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read login key %s: %s", file, err)
+	}
+
+	key = make([]byte, loginKeySize)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate login key: %s", err)
+	}
+
+	os.MkdirAll(filepath.Dir(file), 0755) // Ignore error
+
+	err = ioutil.WriteFile(file, key, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save login key to %s: %s", file, err)
+	}
+	return key, nil
+}
+
+// loginMAC returns the signature of a login cookie. The password hash is
+// included, so changing the password signs the user out.
+func (d *Daemon) loginMAC(name string, expires string, hash []byte) string {
+	d.configLock.RLock()
+	key := d.loginKey
+	d.configLock.RUnlock()
+
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "login\x00%s\x00%s\x00%s", name, expires, hash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setLoginCookie signs in a user.
+func (d *Daemon) setLoginCookie(writer http.ResponseWriter, name string, hash []byte) {
+	expires := strconv.FormatInt(time.Now().Add(loginDuration).Unix(), 10)
+
+	options := d.getOptions()
+	http.SetCookie(writer, &http.Cookie{
+		Name:     loginCookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(name)) + "." + expires + "." + d.loginMAC(name, expires, hash),
+		Path:     d.pagePath("/"),
+		MaxAge:   int(loginDuration / time.Second),
+		HttpOnly: true,
+		Secure:   options.tlsEnabled(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearLoginCookie signs out a user.
+func (d *Daemon) clearLoginCookie(writer http.ResponseWriter) {
+	options := d.getOptions()
+	http.SetCookie(writer, &http.Cookie{
+		Name:     loginCookie,
+		Value:    "",
+		Path:     d.pagePath("/"),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   options.tlsEnabled(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// trustedProxy returns whether a request was sent by a reverse proxy allowed
+// to provide the name of the authenticated user. Requests received via a
+// Unix domain socket are trusted.
+func (o *DaemonOptions) trustedProxy(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	} else if len(o.TrustedProxies) == 0 {
+		return ip.IsLoopback()
+	}
+	for _, proxy := range o.TrustedProxies {
+		if matchIP(proxy, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the name of the user a request was sent by, or an
+// empty string when authentication is disabled.
+func (d *Daemon) authenticate(request *http.Request) (string, error) {
+	options := d.getOptions()
+	switch options.Authentication {
+	case "":
+		return "", nil
+	case AuthenticationHeader:
+		if !options.trustedProxy(request) {
+			return "", ErrNotAuthenticated
+		}
+		header := options.UserHeader
+		if header == "" {
+			header = DefaultUserHeader
+		}
+		name := request.Header.Get(header)
+		if !validUserName(name) {
+			return "", ErrNotAuthenticated
+		}
+		return name, nil
+	case AuthenticationPassword:
+		cookie, err := request.Cookie(loginCookie)
+		if err != nil {
+			return "", ErrNotAuthenticated
+		}
+		split := strings.SplitN(cookie.Value, ".", 3)
+		if len(split) != 3 {
+			return "", ErrNotAuthenticated
+		}
+		nameData, err := base64.RawURLEncoding.DecodeString(split[0])
+		if err != nil {
+			return "", ErrNotAuthenticated
+		}
+		name := string(nameData)
+
+		expires, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil || time.Now().Unix() > expires {
+			return "", ErrNotAuthenticated
+		}
+
+		hash, ok := d.users.hash(options.PasswordFile, name)
+		if !ok || !hmac.Equal([]byte(split[2]), []byte(d.loginMAC(name, split[1], hash))) {
+			return "", ErrNotAuthenticated
+		}
+		return name, nil
+	default:
+		return "", fmt.Errorf("unknown authentication method: %s", options.Authentication)
+	}
+}
+
+// publicPath returns whether a path may be accessed without authentication.
+func publicPath(p string) bool {
+	return p == "/login" || p == "/assets/style.css"
+}
+
+// writeNotAuthenticated asks the client to sign in.
+func (d *Daemon) writeNotAuthenticated(writer http.ResponseWriter, request *http.Request) {
+	if d.getOptions().Authentication == AuthenticationPassword && request.Method == http.MethodGet {
+		http.Redirect(writer, request, d.pagePath("/login")+"?next="+url.QueryEscape(request.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	http.Error(writer, "Error: not authenticated", http.StatusUnauthorized)
+}
+
+// localPath returns a path on the daemon to redirect to after signing in.
+// Paths which may lead to other websites are replaced with the index page.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+}
+
+func (d *Daemon) handleLogin(writer http.ResponseWriter, request *http.Request) {
+	options := d.getOptions()
+	if options.Authentication != AuthenticationPassword {
+		http.Redirect(writer, request, d.pagePath("/"), http.StatusSeeOther)
+		return
+	}
+
+	next := localPath(request.FormValue("next"))
+
+	if request.Method == http.MethodPost {
+		if d.verifyRequest(request) != nil {
+			writeInvalidRequest(writer)
+			return
+		}
+
+		name := request.PostFormValue("name")
+		client := options.clientAddress(request)
+		limitKeys := []string{"user\x00" + name, "client\x00" + client}
+		if d.logins.blocked(limitKeys...) {
+			log.Printf("refused sign in attempt for user %s from %s: too many failed attempts", name, client)
+			writer.WriteHeader(http.StatusTooManyRequests)
+			d.writePage(writer, request, loginTemplate, "", false, &struct {
+				Name    string
+				Next    string
+				Failed  bool
+				Limited bool
+			}{
+				Name:    name,
+				Next:    next,
+				Limited: true,
+			})
+			return
+		}
+
+		hash, ok := d.users.hash(options.PasswordFile, name)
+		if !ok {
+			dummyHashOnce.Do(func() {
+				dummyHash, _ = bcrypt.GenerateFromPassword([]byte("gmitohtml"), bcrypt.DefaultCost)
+			})
+			hash = dummyHash
+		}
+		err := bcrypt.CompareHashAndPassword(hash, []byte(request.PostFormValue("password")))
+		if ok && err == nil {
+			d.logins.reset(limitKeys...)
+			d.setLoginCookie(writer, name, hash)
+			http.Redirect(writer, request, d.pagePath(next), http.StatusSeeOther)
+			return
+		}
+
+		d.logins.fail(limitKeys...)
+		log.Printf("failed sign in attempt for user %s from %s", name, client)
+		writer.WriteHeader(http.StatusForbidden)
+		d.writePage(writer, request, loginTemplate, "", false, &struct {
+			Name    string
+			Next    string
+			Failed  bool
+			Limited bool
+		}{
+			Name:   name,
+			Next:   next,
+			Failed: true,
+		})
+		return
+	}
+
+	d.writePage(writer, request, loginTemplate, "", false, &struct {
+		Name    string
+		Next    string
+		Failed  bool
+		Limited bool
+	}{
+		Next: next,
+	})
+}
+
+func (d *Daemon) handleLogout(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodPost {
+		if d.verifyRequest(request) != nil {
+			writeInvalidRequest(writer)
+			return
+		}
+
+		d.clearLoginCookie(writer)
+		http.Redirect(writer, request, d.pagePath("/login"), http.StatusSeeOther)
+		return
+	}
+
+	d.writePage(writer, request, logoutTemplate, "", false, nil)
+}
+
+func (d *Daemon) handleAdmin(writer http.ResponseWriter, request *http.Request) {
+	options := d.getOptions()
+	user := requestUser(request)
+	if user == "" || !options.isAdmin(user) {
+		http.Error(writer, "Error: access denied", http.StatusForbidden)
+		return
+	}
+	passwords := options.Authentication == AuthenticationPassword
+
+	if request.Method == http.MethodPost {
+		if d.verifyRequest(request) != nil {
+			writeInvalidRequest(writer)
+			return
+		}
+
+		if removeUser := request.PostFormValue("remove"); removeUser != "" {
+			if removeUser == user {
+				http.Error(writer, "Error: you may not remove yourself", http.StatusBadRequest)
+				return
+			}
+			if passwords {
+				err := RemoveUser(options.PasswordFile, removeUser)
+				if err != nil {
+					http.Error(writer, fmt.Sprintf("Error: %s", err), http.StatusInternalServerError)
+					return
+				}
+			}
+			d.RemoveProfile(removeUser)
+		} else if name := request.PostFormValue("name"); name != "" && passwords {
+			err := SetPassword(options.PasswordFile, name, request.PostFormValue("password"))
+			if err != nil {
+				http.Error(writer, fmt.Sprintf("Error: failed to set password: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		http.Redirect(writer, request, d.pagePath("/admin"), http.StatusSeeOther)
+		return
+	}
+
+	if removeUser := request.FormValue("remove"); removeUser != "" {
+		d.writePage(writer, request, removeUserTemplate, "", false, removeUser)
+		return
+	}
+
+	type userInfo struct {
+		Name     string
+		Admin    bool
+		Password bool
+		Profile  bool
+	}
+
+	users := make(map[string]*userInfo)
+	getUser := func(name string) *userInfo {
+		info, ok := users[name]
+		if !ok {
+			info = &userInfo{Name: name, Admin: options.isAdmin(name)}
+			users[name] = info
+		}
+		return info
+	}
+	if passwords {
+		for _, name := range d.users.names(options.PasswordFile) {
+			getUser(name).Password = true
+		}
+	}
+	for _, name := range d.Profiles() {
+		getUser(name).Profile = true
+	}
+
+	var list []*userInfo
+	for _, info := range users {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	d.writePage(writer, request, adminTemplate, "", false, &struct {
+		Passwords bool
+		Self      string
+		Users     []*userInfo
+	}{
+		Passwords: passwords,
+		Self:      user,
+		Users:     list,
+	})
+}
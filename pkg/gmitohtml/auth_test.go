@@ -0,0 +1,247 @@
+package gmitohtml
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPasswordDaemon returns a daemon authenticating the users alice and bob
+// via passwords, which are their names followed by "-password".
+func testPasswordDaemon(t testing.TB, options *DaemonOptions) *Daemon {
+	file := filepath.Join(t.TempDir(), "passwords")
+	for _, name := range []string{"alice", "bob"} {
+		err := SetPassword(file, name, name+"-password")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if options == nil {
+		options = &DaemonOptions{}
+	}
+	options.Authentication = AuthenticationPassword
+	options.PasswordFile = file
+	return NewDaemon(options)
+}
+
+// serveAs serves a request sent from a client address with the specified
+// cookies.
+func serveAs(d *Daemon, method string, target string, remoteAddr string, cookies []*http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	request := httptest.NewRequest(method, "http://localhost"+target, body)
+	request.RemoteAddr = remoteAddr
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, request)
+	return w
+}
+
+// responseCookie returns a cookie set by a response.
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// testLogin signs in a user from a client address and returns the response
+// and the cookies of the client.
+func testLogin(t testing.TB, d *Daemon, remoteAddr string, name string, password string) (*httptest.ResponseRecorder, []*http.Cookie) {
+	w := serveAs(d, "GET", "/login", remoteAddr, nil, nil)
+	session := responseCookie(w, sessionCookie)
+	if session == nil {
+		t.Fatal("no session cookie was set")
+	}
+	cookies := []*http.Cookie{session}
+
+	w = serveAs(d, "POST", "/login", remoteAddr, cookies, url.Values{csrfField: {d.requestToken(session.Value)}, "name": {name}, "password": {password}, "next": {"/bookmarks"}})
+	if login := responseCookie(w, loginCookie); login != nil {
+		cookies = append(cookies, login)
+	}
+	return w, cookies
+}
+
+func TestReadPasswordFileLongLine(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "passwords")
+	data := "# " + strings.Repeat("a", 256*1024) + "\nuser:hash\n"
+	err := ioutil.WriteFile(file, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes, err := readPasswordFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(hashes["user"]) != "hash" {
+		t.Errorf("expected hash of user to be read, got %q", hashes["user"])
+	}
+}
+
+func TestLogin(t *testing.T) {
+	d := testPasswordDaemon(t, &DaemonOptions{Bookmarks: true})
+
+	w := serveAs(d, "GET", "/bookmarks", "192.0.2.1:1234", nil, nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Fbookmarks" {
+		t.Fatalf("expected redirect to sign in page, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w, cookies := testLogin(t, d, "192.0.2.1:1234", "alice", "wrong")
+	if w.Code != http.StatusForbidden || len(cookies) != 1 {
+		t.Errorf("expected wrong password to be refused, got %d", w.Code)
+	}
+	w, cookies = testLogin(t, d, "192.0.2.1:1234", "carol", "carol-password")
+	if w.Code != http.StatusForbidden || len(cookies) != 1 {
+		t.Errorf("expected unknown user to be refused, got %d", w.Code)
+	}
+
+	w, cookies = testLogin(t, d, "192.0.2.1:1234", "alice", "alice-password")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/bookmarks" || len(cookies) != 2 {
+		t.Fatalf("expected sign in to succeed, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	w = serveAs(d, "GET", "/bookmarks", "192.0.2.1:1234", cookies, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected signed in user to be served, got %d", w.Code)
+	}
+
+	// Signing out clears the login cookie.
+	w = serveAs(d, "POST", "/logout", "192.0.2.1:1234", cookies, url.Values{csrfField: {d.requestToken(cookies[0].Value)}})
+	login := responseCookie(w, loginCookie)
+	if w.Code != http.StatusSeeOther || login == nil || login.Value != "" || login.MaxAge >= 0 {
+		t.Errorf("expected login cookie to be cleared, got %d %+v", w.Code, login)
+	}
+
+	// Signing out requires a request token.
+	w = serveAs(d, "POST", "/logout", "192.0.2.1:1234", cookies, url.Values{})
+	if w.Code != http.StatusForbidden || responseCookie(w, loginCookie) != nil {
+		t.Errorf("expected sign out without request token to be refused, got %d", w.Code)
+	}
+}
+
+func TestLoginExpired(t *testing.T) {
+	d := testPasswordDaemon(t, nil)
+	hash, _ := d.users.hash(d.getOptions().PasswordFile, "alice")
+
+	tests := []struct {
+		name    string
+		expires time.Time
+		valid   bool
+	}{
+		{"valid", time.Now().Add(time.Hour), true},
+		{"expired", time.Now().Add(-time.Second), false},
+	}
+	for _, test := range tests {
+		expires := strconv.FormatInt(test.expires.Unix(), 10)
+		cookie := &http.Cookie{Name: loginCookie, Value: "YWxpY2U." + expires + "." + d.loginMAC("alice", expires, hash)}
+		w := serveAs(d, "GET", "/", "192.0.2.1:1234", []*http.Cookie{cookie}, nil)
+		if redirected := w.Code == http.StatusSeeOther; redirected == test.valid {
+			t.Errorf("%s: expected login cookie to be valid: %v, got %d", test.name, test.valid, w.Code)
+		}
+	}
+
+	// Changing the expiry invalidates the signature.
+	expires := strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+	later := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	cookie := &http.Cookie{Name: loginCookie, Value: "YWxpY2U." + later + "." + d.loginMAC("alice", expires, hash)}
+	w := serveAs(d, "GET", "/", "192.0.2.1:1234", []*http.Cookie{cookie}, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("expected login cookie with modified expiry to be refused, got %d", w.Code)
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	d := testPasswordDaemon(t, nil)
+
+	for i := 0; i < maxLoginFailures; i++ {
+		w, _ := testLogin(t, d, "192.0.2.1:1234", "alice", "wrong")
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("expected wrong password to be refused, got %d", w.Code)
+		}
+	}
+
+	// Further attempts are refused, even with the right password.
+	w, cookies := testLogin(t, d, "192.0.2.1:1234", "alice", "alice-password")
+	if w.Code != http.StatusTooManyRequests || len(cookies) != 1 {
+		t.Errorf("expected sign in to be limited by user, got %d", w.Code)
+	}
+	w, _ = testLogin(t, d, "192.0.2.2:1234", "alice", "alice-password")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected sign in from other client to be limited by user, got %d", w.Code)
+	}
+	w, _ = testLogin(t, d, "192.0.2.1:1234", "bob", "bob-password")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected sign in as other user to be limited by client, got %d", w.Code)
+	}
+	w, _ = testLogin(t, d, "192.0.2.2:1234", "bob", "bob-password")
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("expected sign in as other user from other client to succeed, got %d", w.Code)
+	}
+
+	// Attempts are allowed again after the window passed.
+	for _, f := range d.logins.failures {
+		f.start = f.start.Add(-loginFailureWindow)
+	}
+	w, _ = testLogin(t, d, "192.0.2.1:1234", "alice", "alice-password")
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("expected sign in to succeed after window, got %d", w.Code)
+	}
+}
+
+func TestProfileIsolation(t *testing.T) {
+	address := testGeminiServer(t, staticResponse("20 text/gemini\r\n# Page\n"))
+	d := testPasswordDaemon(t, &DaemonOptions{Hostname: address, Bookmarks: true, History: true})
+	d.SetOnProfileCreated(func(p *Profile) {
+		p.EnableHistory("", 0)
+	})
+
+	_, alice := testLogin(t, d, "192.0.2.1:1234", "alice", "alice-password")
+	_, bob := testLogin(t, d, "192.0.2.2:1234", "bob", "bob-password")
+
+	w := serveAs(d, "POST", "/bookmarks", "192.0.2.1:1234", alice, url.Values{csrfField: {d.requestToken(alice[0].Value)}, "address": {"gemini://example.org/alice"}, "label": {"Alice"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected bookmark to be added, got %d", w.Code)
+	}
+	w = serveAs(d, "GET", "/page.gmi", "192.0.2.1:1234", alice, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected page to be served, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if _, ok := d.Profile("alice").GetBookmarks()["gemini://example.org/alice"]; !ok {
+		t.Error("expected bookmark to be added to profile of alice")
+	} else if _, ok := d.Profile("bob").GetBookmarks()["gemini://example.org/alice"]; ok {
+		t.Error("bookmark of alice was added to profile of bob")
+	} else if _, ok := d.GetBookmarks()["gemini://example.org/alice"]; ok {
+		t.Error("bookmark of alice was added to default profile")
+	}
+	if len(d.Profile("alice").GetHistory()) != 1 {
+		t.Errorf("expected page to be recorded in history of alice, got %+v", d.Profile("alice").GetHistory())
+	} else if len(d.Profile("bob").GetHistory()) != 0 {
+		t.Errorf("history of alice was recorded in profile of bob")
+	}
+
+	w = serveAs(d, "GET", "/bookmarks", "192.0.2.2:1234", bob, nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "gemini://example.org/alice") {
+		t.Errorf("expected bookmarks of bob to be served without bookmark of alice, got %d", w.Code)
+	}
+	w = serveAs(d, "GET", "/history", "192.0.2.2:1234", bob, nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "page.gmi") {
+		t.Errorf("expected history of bob to be served without page visited by alice, got %d", w.Code)
+	}
+}
@@ -0,0 +1,473 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bookmark import and export formats.
+const (
+	BookmarkFormatGemtext  = "gemtext"
+	BookmarkFormatNetscape = "netscape"
+	BookmarkFormatLagrange = "lagrange"
+	BookmarkFormatAmfora   = "amfora"
+)
+
+// ErrUnsupportedFormat is the error returned when an unsupported bookmark
+// format is specified.
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+var bookmarkFormats = []string{
+	BookmarkFormatGemtext,
+	BookmarkFormatNetscape,
+	BookmarkFormatLagrange,
+	BookmarkFormatAmfora,
+}
+
+var bookmarkFormatNames = map[string]string{
+	BookmarkFormatGemtext:  "Gemtext",
+	BookmarkFormatNetscape: "Netscape HTML",
+	BookmarkFormatLagrange: "Lagrange",
+	BookmarkFormatAmfora:   "Amfora",
+}
+
+var bookmarkFormatFiles = map[string]string{
+	BookmarkFormatGemtext:  "bookmarks.gmi",
+	BookmarkFormatNetscape: "bookmarks.html",
+	BookmarkFormatLagrange: "bookmarks.ini",
+	BookmarkFormatAmfora:   "bookmarks.xml",
+}
+
+var bookmarkFormatTypes = map[string]string{
+	BookmarkFormatGemtext:  "text/gemini; charset=utf-8",
+	BookmarkFormatNetscape: "text/html; charset=utf-8",
+	BookmarkFormatLagrange: "text/plain; charset=utf-8",
+	BookmarkFormatAmfora:   "application/xml; charset=utf-8",
+}
+
+// ImportBookmarks parses bookmarks in the specified format.
+func ImportBookmarks(data []byte, format string) ([]*Bookmark, error) {
+	switch format {
+	case BookmarkFormatGemtext:
+		return importGemtextBookmarks(data), nil
+	case BookmarkFormatNetscape:
+		return importNetscapeBookmarks(data), nil
+	case BookmarkFormatLagrange:
+		return importLagrangeBookmarks(data)
+	case BookmarkFormatAmfora:
+		return importAmforaBookmarks(data)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// ExportBookmarks formats bookmarks in the specified format.
+func ExportBookmarks(bookmarks []*Bookmark, format string) ([]byte, error) {
+	switch format {
+	case BookmarkFormatGemtext:
+		return exportGemtextBookmarks(bookmarks), nil
+	case BookmarkFormatNetscape:
+		return exportNetscapeBookmarks(bookmarks), nil
+	case BookmarkFormatLagrange:
+		return exportLagrangeBookmarks(bookmarks), nil
+	case BookmarkFormatAmfora:
+		return exportAmforaBookmarks(bookmarks)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// Gemtext bookmarks are a list of links. Each folder is a level two heading.
+
+func importGemtextBookmarks(data []byte) []*Bookmark {
+	var imported []*Bookmark
+	var folder string
+
+	scanner := newLineScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "##") {
+			folder = normalizeFolder(strings.TrimLeft(line, "#"))
+			continue
+		}
+
+		linkURL, linkLabel := splitLink(line)
+		if linkURL == "" {
+			continue
+		}
+		imported = append(imported, &Bookmark{
+			URL:    linkURL,
+			Label:  linkLabel,
+			Folder: folder,
+		})
+	}
+	return imported
+}
+
+// gemtextLine replaces line breaks, which would end a line of text/gemini,
+// with spaces.
+var gemtextLine = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func exportGemtextBookmarks(bookmarks []*Bookmark) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Bookmarks\n")
+
+	folder := "\x00"
+	for _, bookmark := range bookmarks {
+		if bookmark.Folder != folder {
+			folder = bookmark.Folder
+			if folder != "" {
+				b.WriteString("\n## " + gemtextLine.Replace(folder) + "\n")
+			} else {
+				b.WriteString("\n")
+			}
+		}
+		b.WriteString("=> " + bookmark.URL + " " + gemtextLine.Replace(bookmark.Label) + "\n")
+	}
+	return b.Bytes()
+}
+
+// Netscape bookmarks are exported by most web browsers.
+
+var (
+	netscapeTokenPattern     = regexp.MustCompile(`(?is)<dl[^>]*>|</dl>|<h3[^>]*>(.*?)</h3>|<a\s([^>]*)>(.*?)</a>`)
+	netscapeAttributePattern = regexp.MustCompile(`(?is)([a-z_-]+)\s*=\s*"([^"]*)"`)
+)
+
+func importNetscapeBookmarks(data []byte) []*Bookmark {
+	var imported []*Bookmark
+	var folders []string
+	var nextFolder string
+
+	for _, match := range netscapeTokenPattern.FindAllSubmatch(data, -1) {
+		token := strings.ToLower(string(match[0]))
+		switch {
+		case strings.HasPrefix(token, "<dl"):
+			folders = append(folders, nextFolder)
+			nextFolder = ""
+		case token == "</dl>":
+			if len(folders) > 0 {
+				folders = folders[:len(folders)-1]
+			}
+		case strings.HasPrefix(token, "<h3"):
+			nextFolder = strings.ReplaceAll(html.UnescapeString(string(match[1])), "/", "-")
+		default:
+			b := &Bookmark{
+				Label:  strings.TrimSpace(html.UnescapeString(string(match[3]))),
+				Folder: normalizeFolder(strings.Join(folders, "/")),
+			}
+			for _, attribute := range netscapeAttributePattern.FindAllSubmatch(match[2], -1) {
+				value := html.UnescapeString(string(attribute[2]))
+				switch strings.ToLower(string(attribute[1])) {
+				case "href":
+					b.URL = value
+				case "tags":
+					b.Tags = parseTags(value)
+				}
+			}
+			if b.URL != "" {
+				imported = append(imported, b)
+			}
+		}
+	}
+	return imported
+}
+
+func exportNetscapeBookmarks(bookmarks []*Bookmark) []byte {
+	var b bytes.Buffer
+	b.WriteString("<!DOCTYPE NETSCAPE-Bookmark-file-1>\n")
+	b.WriteString(`<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">` + "\n")
+	b.WriteString("<TITLE>Bookmarks</TITLE>\n<H1>Bookmarks</H1>\n<DL><p>\n")
+
+	var open []string
+	for _, bookmark := range bookmarks {
+		var elements []string
+		if bookmark.Folder != "" {
+			elements = strings.Split(bookmark.Folder, "/")
+		}
+
+		common := 0
+		for common < len(open) && common < len(elements) && open[common] == elements[common] {
+			common++
+		}
+		for len(open) > common {
+			open = open[:len(open)-1]
+			b.WriteString(strings.Repeat("    ", len(open)+1) + "</DL><p>\n")
+		}
+		for _, element := range elements[common:] {
+			indent := strings.Repeat("    ", len(open)+1)
+			b.WriteString(indent + "<DT><H3>" + html.EscapeString(element) + "</H3>\n")
+			b.WriteString(indent + "<DL><p>\n")
+			open = append(open, element)
+		}
+
+		b.WriteString(strings.Repeat("    ", len(open)+1) + `<DT><A HREF="` + html.EscapeString(bookmark.URL) + `"`)
+		if len(bookmark.Tags) > 0 {
+			b.WriteString(` TAGS="` + html.EscapeString(strings.Join(bookmark.Tags, ",")) + `"`)
+		}
+		b.WriteString(">" + html.EscapeString(bookmark.Label) + "</A>\n")
+	}
+	for len(open) > 0 {
+		open = open[:len(open)-1]
+		b.WriteString(strings.Repeat("    ", len(open)+1) + "</DL><p>\n")
+	}
+
+	b.WriteString("</DL><p>\n")
+	return b.Bytes()
+}
+
+// Lagrange stores bookmarks in bookmarks.ini. Each bookmark and folder is a
+// section identified by a number. Folders have no URL, and items refer to
+// their folder via the parent key.
+
+type lagrangeItem struct {
+	id     int
+	url    string
+	title  string
+	tags   string
+	parent int
+	order  int
+}
+
+func importLagrangeBookmarks(data []byte) ([]*Bookmark, error) {
+	items := make(map[int]*lagrangeItem)
+	var current *lagrangeItem
+
+	scanner := newLineScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			id, err := strconv.Atoi(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid section %s", line)
+			}
+			current = &lagrangeItem{id: id}
+			items[id] = current
+			continue
+		} else if current == nil {
+			continue
+		}
+
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(split[0])
+		value := strings.TrimSpace(split[1])
+		if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", value)
+			}
+			value = unquoted
+		}
+
+		switch key {
+		case "url":
+			current.url = value
+		case "title":
+			current.title = value
+		case "tags":
+			current.tags = value
+		case "parent":
+			current.parent, _ = strconv.Atoi(value)
+		case "order":
+			current.order, _ = strconv.Atoi(value)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	var folderPath func(id int, depth int) string
+	folderPath = func(id int, depth int) string {
+		item, ok := items[id]
+		if !ok || item.url != "" || depth > len(items) {
+			return ""
+		}
+		title := strings.ReplaceAll(item.title, "/", "-")
+		parent := folderPath(item.parent, depth+1)
+		if parent == "" {
+			return title
+		}
+		return parent + "/" + title
+	}
+
+	var sortedItems []*lagrangeItem
+	for _, item := range items {
+		if item.url != "" {
+			sortedItems = append(sortedItems, item)
+		}
+	}
+	sort.Slice(sortedItems, func(i, j int) bool {
+		if sortedItems[i].order != sortedItems[j].order {
+			return sortedItems[i].order < sortedItems[j].order
+		}
+		return sortedItems[i].id < sortedItems[j].id
+	})
+
+	var imported []*Bookmark
+	for _, item := range sortedItems {
+		b := &Bookmark{
+			URL:    item.url,
+			Label:  item.title,
+			Folder: normalizeFolder(folderPath(item.parent, 0)),
+		}
+		for _, tag := range strings.Fields(item.tags) {
+			// Lagrange uses dot-prefixed tags internally (e.g. .remote).
+			if !strings.HasPrefix(tag, ".") {
+				b.Tags = append(b.Tags, tag)
+			}
+		}
+		imported = append(imported, b)
+	}
+	return imported, nil
+}
+
+func exportLagrangeBookmarks(bookmarks []*Bookmark) []byte {
+	var b bytes.Buffer
+
+	id := 1
+	created := time.Now().Unix()
+	folderIDs := make(map[string]int)
+
+	var folderID func(folder string) int
+	folderID = func(folder string) int {
+		if folder == "" {
+			return 0
+		}
+		if fid, ok := folderIDs[folder]; ok {
+			return fid
+		}
+
+		parent := 0
+		title := folder
+		if i := strings.LastIndex(folder, "/"); i != -1 {
+			parent = folderID(folder[:i])
+			title = folder[i+1:]
+		}
+
+		fid := id
+		id++
+		folderIDs[folder] = fid
+
+		fmt.Fprintf(&b, "[%d]\ntitle = %s\ncreated = %d\n", fid, strconv.Quote(title), created)
+		if parent != 0 {
+			fmt.Fprintf(&b, "parent = %d\n", parent)
+		}
+		fmt.Fprintf(&b, "order = %d\n\n", fid)
+		return fid
+	}
+
+	for _, bookmark := range bookmarks {
+		parent := folderID(bookmark.Folder)
+
+		bid := id
+		id++
+		fmt.Fprintf(&b, "[%d]\nurl = %s\ntitle = %s\ntags = %s\ncreated = %d\n", bid, strconv.Quote(bookmark.URL), strconv.Quote(bookmark.Label), strconv.Quote(strings.Join(bookmark.Tags, " ")), created)
+		if parent != 0 {
+			fmt.Fprintf(&b, "parent = %d\n", parent)
+		}
+		fmt.Fprintf(&b, "order = %d\n\n", bid)
+	}
+	return b.Bytes()
+}
+
+// Amfora stores bookmarks in XBEL format.
+
+type xbelBookmark struct {
+	Href  string `xml:"href,attr"`
+	Title string `xml:"title"`
+}
+
+type xbelFolder struct {
+	Title     string          `xml:"title"`
+	Bookmarks []*xbelBookmark `xml:"bookmark"`
+	Folders   []*xbelFolder   `xml:"folder"`
+}
+
+type xbelDocument struct {
+	XMLName   xml.Name        `xml:"xbel"`
+	Version   string          `xml:"version,attr"`
+	Bookmarks []*xbelBookmark `xml:"bookmark"`
+	Folders   []*xbelFolder   `xml:"folder"`
+}
+
+const xbelDoctype = `<!DOCTYPE xbel PUBLIC "+//IDN python.org//DTD XML Bookmark Exchange Language 1.0//EN//XML" "http://pyxml.sourceforge.net/topics/dtds/xbel.dtd">` + "\n"
+
+func importAmforaBookmarks(data []byte) ([]*Bookmark, error) {
+	var doc xbelDocument
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var imported []*Bookmark
+	var walk func(folder string, bookmarks []*xbelBookmark, folders []*xbelFolder)
+	walk = func(folder string, bookmarks []*xbelBookmark, folders []*xbelFolder) {
+		for _, b := range bookmarks {
+			imported = append(imported, &Bookmark{
+				URL:    b.Href,
+				Label:  strings.TrimSpace(b.Title),
+				Folder: normalizeFolder(folder),
+			})
+		}
+		for _, f := range folders {
+			walk(folder+"/"+strings.ReplaceAll(f.Title, "/", "-"), f.Bookmarks, f.Folders)
+		}
+	}
+	walk("", doc.Bookmarks, doc.Folders)
+	return imported, nil
+}
+
+func exportAmforaBookmarks(bookmarks []*Bookmark) ([]byte, error) {
+	doc := &xbelDocument{Version: "1.0"}
+	folders := make(map[string]*xbelFolder)
+
+	var getFolder func(folder string) *xbelFolder
+	getFolder = func(folder string) *xbelFolder {
+		if f, ok := folders[folder]; ok {
+			return f
+		}
+
+		f := &xbelFolder{Title: folder}
+		if i := strings.LastIndex(folder, "/"); i != -1 {
+			f.Title = folder[i+1:]
+			parent := getFolder(folder[:i])
+			parent.Folders = append(parent.Folders, f)
+		} else {
+			doc.Folders = append(doc.Folders, f)
+		}
+		folders[folder] = f
+		return f
+	}
+
+	for _, b := range bookmarks {
+		x := &xbelBookmark{Href: b.URL, Title: b.Label}
+		if b.Folder == "" {
+			doc.Bookmarks = append(doc.Bookmarks, x)
+			continue
+		}
+		f := getFolder(b.Folder)
+		f.Bookmarks = append(f.Bookmarks, x)
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header+xbelDoctype), append(out, '\n')...), nil
+}
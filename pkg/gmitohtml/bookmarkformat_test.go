@@ -0,0 +1,57 @@
+package gmitohtml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImportLagrangeBookmarksLongLine(t *testing.T) {
+	label := strings.Repeat("a", 256*1024)
+	bookmarks := []*Bookmark{
+		{URL: "gemini://example.org/", Label: label, Folder: "Reading"},
+		{URL: "gemini://example.com/", Label: "After"},
+	}
+	data, err := ExportBookmarks(bookmarks, BookmarkFormatLagrange)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	imported, err := ImportBookmarks(data, BookmarkFormatLagrange)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(imported) != len(bookmarks) {
+		t.Fatalf("expected %d bookmarks, got %d", len(bookmarks), len(imported))
+	}
+	for i, b := range bookmarks {
+		if imported[i].URL != b.URL || imported[i].Label != b.Label || imported[i].Folder != b.Folder {
+			t.Errorf("bookmark %d: expected %s (%d bytes) in %q, got %s (%d bytes) in %q", i, b.URL, len(b.Label), b.Folder, imported[i].URL, len(imported[i].Label), imported[i].Folder)
+		}
+	}
+}
+
+func TestExportGemtextBookmarksLineBreaks(t *testing.T) {
+	bookmarks := []*Bookmark{
+		{URL: "gemini://example.com/", Label: "First\rline"},
+		{URL: "gemini://example.org/", Label: "Second\r\n=> gemini://evil.example/ Injected", Folder: "Reading\n## Injected"},
+	}
+	data, err := ExportBookmarks(bookmarks, BookmarkFormatGemtext)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	imported, err := ImportBookmarks(data, BookmarkFormatGemtext)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(imported) != len(bookmarks) {
+		t.Fatalf("expected %d bookmarks, got %d:\n%s", len(bookmarks), len(imported), data)
+	}
+	expected := []*Bookmark{
+		{URL: "gemini://example.com/", Label: "First line"},
+		{URL: "gemini://example.org/", Label: "Second => gemini://evil.example/ Injected", Folder: "Reading ## Injected"},
+	}
+	for i, b := range expected {
+		if imported[i].URL != b.URL || imported[i].Label != b.Label || imported[i].Folder != b.Folder {
+			t.Errorf("bookmark %d: expected %s %q in %q, got %s %q in %q", i, b.URL, b.Label, b.Folder, imported[i].URL, imported[i].Label, imported[i].Folder)
+		}
+	}
+}
@@ -0,0 +1,646 @@
+package gmitohtml
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Bookmark is a bookmarked page.
+type Bookmark struct {
+	URL   string
+	Label string
+
+	// Folder is the slash-separated path of the folder containing the
+	// bookmark. Bookmarks with an empty folder are not in a folder.
+	Folder string
+
+	Tags []string
+
+	// Position is the position of the bookmark within its folder.
+	Position int
+}
+
+func (b *Bookmark) copy() *Bookmark {
+	c := *b
+	c.Tags = append([]string(nil), b.Tags...)
+	return &c
+}
+
+// bookmarkStore holds bookmarks. It is safe for concurrent use. Bookmarks
+// returned by the store are copies.
+type bookmarkStore struct {
+	bookmarks map[string]*Bookmark
+	sorted    []*Bookmark
+	onChanged func()
+	sync.RWMutex
+}
+
+func newBookmarkStore() *bookmarkStore {
+	return &bookmarkStore{
+		bookmarks: make(map[string]*Bookmark),
+	}
+}
+
+var defaultBookmarks = map[string]string{
+	"gemini://gemini.circumlunar.space/": "Project Gemini",
+	"gemini://gus.guru/":                 "GUS - Gemini Universal Search",
+}
+
+// normalizeBookmarkURL returns the URL under which a bookmark is stored.
+func normalizeBookmarkURL(u string) (string, bool) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", false
+	}
+	if parsed.Scheme == "" {
+		parsed.Scheme = "gemini"
+	}
+	parsed.Host = strings.ToLower(parsed.Host)
+	return parsed.String(), true
+}
+
+// normalizeFolder removes empty path elements and surrounding whitespace
+// from a folder path.
+func normalizeFolder(folder string) string {
+	var elements []string
+	for _, element := range strings.Split(folder, "/") {
+		element = strings.TrimSpace(element)
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return strings.Join(elements, "/")
+}
+
+// parseTags parses a comma-separated list of tags.
+func parseTags(tags string) []string {
+	var parsed []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		parsed = append(parsed, tag)
+	}
+	return parsed
+}
+
+// nextPosition returns the position after the last bookmark in a folder.
+// The caller must hold the lock.
+func (s *bookmarkStore) nextPosition(folder string) int {
+	var position int
+	for _, b := range s.bookmarks {
+		if b.Folder == folder && b.Position >= position {
+			position = b.Position + 1
+		}
+	}
+	return position
+}
+
+func (d *Daemon) handleBookmarks(writer http.ResponseWriter, request *http.Request) {
+	p := d.requestProfile(request)
+
+	exportFormat := request.FormValue("export")
+	if exportFormat != "" {
+		out, err := ExportBookmarks(p.GetBookmarkEntries(), exportFormat)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Error: failed to export bookmarks: %s", err), http.StatusBadRequest)
+			return
+		}
+		writer.Header().Set("Content-Type", bookmarkFormatTypes[exportFormat])
+		writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, bookmarkFormatFiles[exportFormat]))
+		writer.Write(out)
+		return
+	}
+
+	if request.Method == http.MethodPost {
+		if d.verifyRequest(request) != nil {
+			writeInvalidRequest(writer)
+			return
+		}
+
+		folder := request.PostFormValue("folder")
+		if request.PostFormValue("format") != "" {
+			file, _, err := request.FormFile("import")
+			if err != nil {
+				http.Error(writer, "Error: no file to import", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+
+			importData, err := ioutil.ReadAll(file)
+			if err != nil {
+				http.Error(writer, fmt.Sprintf("Error: failed to read imported file: %s", err), http.StatusBadRequest)
+				return
+			}
+
+			imported, err := ImportBookmarks(importData, request.PostFormValue("format"))
+			if err != nil {
+				http.Error(writer, fmt.Sprintf("Error: failed to import bookmarks: %s", err), http.StatusBadRequest)
+				return
+			}
+			for _, b := range imported {
+				p.SetBookmark(b)
+			}
+		} else if deleteBookmark := request.PostFormValue("delete"); deleteBookmark != "" {
+			p.RemoveBookmark(deleteBookmark)
+		} else if moveBookmark := request.PostFormValue("move"); moveBookmark != "" {
+			offset := -1
+			if request.PostFormValue("direction") == "down" {
+				offset = 1
+			}
+			p.MoveBookmark(moveBookmark, offset)
+		} else if postAddress := request.PostFormValue("address"); postAddress != "" {
+			postLabel := request.PostFormValue("label")
+			if postLabel == "" {
+				postLabel = postAddress
+			}
+			postBookmark := &Bookmark{
+				URL:    postAddress,
+				Label:  postLabel,
+				Folder: folder,
+				Tags:   parseTags(request.PostFormValue("tags")),
+			}
+
+			editBookmark := request.PostFormValue("edit")
+			if editBookmark != "" && editBookmark != postAddress {
+				p.RemoveBookmark(editBookmark)
+			}
+			p.SetBookmark(postBookmark)
+		}
+
+		redirect := d.pagePath("/bookmarks")
+		if folder = normalizeFolder(folder); folder != "" {
+			redirect += "?folder=" + url.QueryEscape(folder)
+		}
+		http.Redirect(writer, request, redirect, http.StatusSeeOther)
+		return
+	}
+
+	editBookmark := request.FormValue("edit")
+	if editBookmark != "" {
+		b, ok := p.bookmarks.get(editBookmark)
+		if !ok {
+			http.Error(writer, "Error: bookmark not found", http.StatusNotFound)
+			return
+		}
+
+		d.writePage(writer, request, editBookmarkTemplate, "", false, b)
+		return
+	}
+
+	deleteBookmark := request.FormValue("delete")
+	if deleteBookmark != "" {
+		b, ok := p.bookmarks.get(deleteBookmark)
+		if !ok {
+			http.Error(writer, "Error: bookmark not found", http.StatusNotFound)
+			return
+		}
+
+		d.writePage(writer, request, deleteBookmarkTemplate, "", false, b)
+		return
+	}
+
+	folder := normalizeFolder(request.FormValue("folder"))
+	tag := request.FormValue("tag")
+
+	entries := p.bookmarks.entries()
+
+	var shown []*Bookmark
+	for _, b := range entries {
+		if tag != "" {
+			if !hasTag(b, tag) {
+				continue
+			}
+		} else if b.Folder != folder {
+			continue
+		}
+		shown = append(shown, b)
+	}
+
+	type format struct {
+		Format string
+		Name   string
+	}
+	var formats []format
+	for _, f := range bookmarkFormats {
+		formats = append(formats, format{Format: f, Name: bookmarkFormatNames[f]})
+	}
+
+	breadcrumbs, subfolders := bookmarkFolderNavigation(entries, folder)
+
+	d.writePage(writer, request, bookmarksTemplate, "", false, &struct {
+		Add          string
+		Folder       string
+		Tag          string
+		HasBookmarks bool
+		Breadcrumbs  []bookmarkFolder
+		Subfolders   []bookmarkFolder
+		Entries      []*Bookmark
+		Formats      []format
+	}{
+		Add:          request.FormValue("add"),
+		Folder:       folder,
+		Tag:          tag,
+		HasBookmarks: len(entries) > 0,
+		Breadcrumbs:  breadcrumbs,
+		Subfolders:   subfolders,
+		Entries:      shown,
+		Formats:      formats,
+	})
+}
+
+// bookmarkFolder is a link to a bookmark folder.
+type bookmarkFolder struct {
+	Name string
+	Path string
+}
+
+// bookmarkFolderNavigation returns the parent folders and the subfolders of
+// a folder.
+func bookmarkFolderNavigation(entries []*Bookmark, folder string) (breadcrumbs []bookmarkFolder, subfolders []bookmarkFolder) {
+	if folder != "" {
+		elements := strings.Split(folder, "/")
+		for i, element := range elements {
+			breadcrumbs = append(breadcrumbs, bookmarkFolder{Name: element, Path: strings.Join(elements[:i+1], "/")})
+		}
+	}
+
+	prefix := folder
+	if prefix != "" {
+		prefix += "/"
+	}
+	seen := make(map[string]bool)
+	for _, b := range entries {
+		if !strings.HasPrefix(b.Folder, prefix) || b.Folder == folder {
+			continue
+		}
+		f := strings.SplitN(b.Folder[len(prefix):], "/", 2)[0]
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		subfolders = append(subfolders, bookmarkFolder{Name: f, Path: prefix + f})
+	}
+	sort.Slice(subfolders, func(i, j int) bool {
+		return strings.ToLower(subfolders[i].Name) < strings.ToLower(subfolders[j].Name)
+	})
+	return breadcrumbs, subfolders
+}
+
+func hasTag(b *Bookmark, tag string) bool {
+	for _, t := range b.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *bookmarkStore) set(b *Bookmark) {
+	normalized, ok := normalizeBookmarkURL(b.URL)
+	if !ok {
+		return
+	}
+
+	b = b.copy()
+	b.URL = normalized
+
+	s.Lock()
+	s.setLocked(b)
+	s.Unlock()
+
+	s.changed()
+}
+
+// setLocked stores a bookmark with a normalized URL. A bookmark remaining in
+// the same folder keeps its position. The caller must hold the lock.
+func (s *bookmarkStore) setLocked(b *Bookmark) {
+	b.Folder = normalizeFolder(b.Folder)
+	if b.Label == "" {
+		b.Label = b.URL
+	}
+
+	existing, ok := s.bookmarks[b.URL]
+	if ok && existing.Folder == b.Folder {
+		b.Position = existing.Position
+	} else {
+		b.Position = s.nextPosition(b.Folder)
+	}
+
+	s.bookmarks[b.URL] = b
+	s.sort()
+}
+
+// add adds a bookmark or changes its label. The folder and tags of an
+// existing bookmark are kept.
+func (s *bookmarkStore) add(u string, label string) {
+	normalized, ok := normalizeBookmarkURL(u)
+	if !ok {
+		return
+	}
+
+	b := &Bookmark{URL: normalized, Label: label}
+
+	s.Lock()
+	if existing, ok := s.bookmarks[normalized]; ok {
+		b.Folder = existing.Folder
+		b.Tags = append([]string(nil), existing.Tags...)
+	}
+	s.setLocked(b)
+	s.Unlock()
+
+	s.changed()
+}
+
+func (s *bookmarkStore) get(u string) (*Bookmark, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	b, ok := s.bookmarks[u]
+	if !ok {
+		return nil, false
+	}
+	return b.copy(), true
+}
+
+func (s *bookmarkStore) labels() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+
+	labels := make(map[string]string, len(s.bookmarks))
+	for u, b := range s.bookmarks {
+		labels[u] = b.Label
+	}
+	return labels
+}
+
+func (s *bookmarkStore) entries() []*Bookmark {
+	s.RLock()
+	defer s.RUnlock()
+
+	entries := make([]*Bookmark, len(s.sorted))
+	for i, b := range s.sorted {
+		entries[i] = b.copy()
+	}
+	return entries
+}
+
+func (s *bookmarkStore) move(u string, offset int) {
+	s.Lock()
+	moved := s.moveLocked(u, offset)
+	s.Unlock()
+
+	if moved {
+		s.changed()
+	}
+}
+
+// moveLocked moves a bookmark and returns whether it was moved. The caller
+// must hold the lock.
+func (s *bookmarkStore) moveLocked(u string, offset int) bool {
+	b, ok := s.bookmarks[u]
+	if !ok || offset == 0 {
+		return false
+	}
+
+	var folder []*Bookmark
+	var index int
+	for _, sorted := range s.sorted {
+		if sorted.Folder != b.Folder {
+			continue
+		}
+		if sorted == b {
+			index = len(folder)
+		}
+		folder = append(folder, sorted)
+	}
+
+	newIndex := index + offset
+	if newIndex < 0 {
+		newIndex = 0
+	} else if newIndex >= len(folder) {
+		newIndex = len(folder) - 1
+	}
+	if newIndex == index {
+		return false
+	}
+
+	folder = append(folder[:index], folder[index+1:]...)
+	folder = append(folder[:newIndex], append([]*Bookmark{b}, folder[newIndex:]...)...)
+	for i, sorted := range folder {
+		sorted.Position = i
+	}
+
+	s.sort()
+	return true
+}
+
+func (s *bookmarkStore) remove(u string) {
+	s.Lock()
+	delete(s.bookmarks, u)
+	s.sort()
+	s.Unlock()
+
+	s.changed()
+}
+
+// replace replaces all bookmarks. Bookmarks are positioned within their
+// folder in the order specified.
+func (s *bookmarkStore) replace(bookmarks []*Bookmark) {
+	positions := make(map[string]int)
+
+	s.Lock()
+	s.bookmarks = make(map[string]*Bookmark)
+	for _, b := range bookmarks {
+		normalized, ok := normalizeBookmarkURL(b.URL)
+		if !ok {
+			continue
+		}
+
+		b = b.copy()
+		b.URL = normalized
+		b.Folder = normalizeFolder(b.Folder)
+		if b.Label == "" {
+			b.Label = b.URL
+		}
+		if existing, ok := s.bookmarks[b.URL]; ok && existing.Folder == b.Folder {
+			b.Position = existing.Position
+		} else {
+			b.Position = positions[b.Folder]
+			positions[b.Folder]++
+		}
+		s.bookmarks[b.URL] = b
+	}
+	s.sort()
+	s.Unlock()
+
+	s.changed()
+}
+
+// sort updates the sorted list of bookmarks. The caller must hold the lock.
+func (s *bookmarkStore) sort() {
+	var allBookmarks []*Bookmark
+	for _, b := range s.bookmarks {
+		allBookmarks = append(allBookmarks, b)
+	}
+	sort.Slice(allBookmarks, func(i, j int) bool {
+		a, b := allBookmarks[i], allBookmarks[j]
+		if a.Folder != b.Folder {
+			return strings.ToLower(a.Folder) < strings.ToLower(b.Folder)
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return strings.ToLower(a.Label) < strings.ToLower(b.Label)
+	})
+
+	s.sorted = allBookmarks
+}
+
+// changed calls the function set via SetOnBookmarksChanged. The lock must
+// not be held, as the function may access the store.
+func (s *bookmarkStore) changed() {
+	s.RLock()
+	onChanged := s.onChanged
+	s.RUnlock()
+
+	if onChanged != nil {
+		onChanged()
+	}
+}
+
+// SetOnBookmarksChanged sets the function called when a bookmark is changed.
+func (p *Profile) SetOnBookmarksChanged(f func()) {
+	p.bookmarks.Lock()
+	p.bookmarks.onChanged = f
+	p.bookmarks.Unlock()
+}
+
+// AddBookmark adds a bookmark. When the URL is already bookmarked, its label
+// is updated.
+func (p *Profile) AddBookmark(u string, label string) {
+	p.bookmarks.add(u, label)
+}
+
+// SetBookmark adds or updates a bookmark. New bookmarks, and bookmarks moved
+// to a different folder, are placed at the end of their folder.
+func (p *Profile) SetBookmark(b *Bookmark) {
+	p.bookmarks.set(b)
+}
+
+// GetBookmarks returns the label of each bookmark.
+func (p *Profile) GetBookmarks() map[string]string {
+	return p.bookmarks.labels()
+}
+
+// GetBookmarkEntries returns all bookmarks, sorted by folder and position.
+func (p *Profile) GetBookmarkEntries() []*Bookmark {
+	return p.bookmarks.entries()
+}
+
+// SetBookmarks replaces all bookmarks.
+func (p *Profile) SetBookmarks(bookmarks []*Bookmark) {
+	p.bookmarks.replace(bookmarks)
+}
+
+// MoveBookmark moves a bookmark within its folder by the specified offset.
+func (p *Profile) MoveBookmark(u string, offset int) {
+	p.bookmarks.move(u, offset)
+}
+
+// RemoveBookmark removes a bookmark.
+func (p *Profile) RemoveBookmark(u string) {
+	p.bookmarks.remove(u)
+}
+
+// SetOnBookmarksChanged sets the function called when a bookmark is changed.
+func (d *Daemon) SetOnBookmarksChanged(f func()) {
+	d.profile.SetOnBookmarksChanged(f)
+}
+
+// AddBookmark adds a bookmark. When the URL is already bookmarked, its label
+// is updated.
+func (d *Daemon) AddBookmark(u string, label string) {
+	d.profile.AddBookmark(u, label)
+}
+
+// SetBookmark adds or updates a bookmark. New bookmarks, and bookmarks moved
+// to a different folder, are placed at the end of their folder.
+func (d *Daemon) SetBookmark(b *Bookmark) {
+	d.profile.SetBookmark(b)
+}
+
+// GetBookmarks returns the label of each bookmark.
+func (d *Daemon) GetBookmarks() map[string]string {
+	return d.profile.GetBookmarks()
+}
+
+// GetBookmarkEntries returns all bookmarks, sorted by folder and position.
+func (d *Daemon) GetBookmarkEntries() []*Bookmark {
+	return d.profile.GetBookmarkEntries()
+}
+
+// SetBookmarks replaces all bookmarks.
+func (d *Daemon) SetBookmarks(bookmarks []*Bookmark) {
+	d.profile.SetBookmarks(bookmarks)
+}
+
+// MoveBookmark moves a bookmark within its folder by the specified offset.
+func (d *Daemon) MoveBookmark(u string, offset int) {
+	d.profile.MoveBookmark(u, offset)
+}
+
+// RemoveBookmark removes a bookmark.
+func (d *Daemon) RemoveBookmark(u string) {
+	d.profile.RemoveBookmark(u)
+}
+
+// SetOnBookmarksChanged sets the function called when a bookmark is changed.
+func SetOnBookmarksChanged(f func()) {
+	defaultDaemon.SetOnBookmarksChanged(f)
+}
+
+// AddBookmark adds a bookmark. When the URL is already bookmarked, its label
+// is updated.
+func AddBookmark(u string, label string) {
+	defaultDaemon.AddBookmark(u, label)
+}
+
+// SetBookmark adds or updates a bookmark. New bookmarks, and bookmarks moved
+// to a different folder, are placed at the end of their folder.
+func SetBookmark(b *Bookmark) {
+	defaultDaemon.SetBookmark(b)
+}
+
+// GetBookmarks returns the label of each bookmark.
+func GetBookmarks() map[string]string {
+	return defaultDaemon.GetBookmarks()
+}
+
+// GetBookmarkEntries returns all bookmarks, sorted by folder and position.
+func GetBookmarkEntries() []*Bookmark {
+	return defaultDaemon.GetBookmarkEntries()
+}
+
+// SetBookmarks replaces all bookmarks.
+func SetBookmarks(bookmarks []*Bookmark) {
+	defaultDaemon.SetBookmarks(bookmarks)
+}
+
+// MoveBookmark moves a bookmark within its folder by the specified offset.
+func MoveBookmark(u string, offset int) {
+	defaultDaemon.MoveBookmark(u, offset)
+}
+
+// RemoveBookmark removes a bookmark.
+func RemoveBookmark(u string) {
+	defaultDaemon.RemoveBookmark(u)
+}
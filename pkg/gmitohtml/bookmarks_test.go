@@ -0,0 +1,63 @@
+package gmitohtml
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBookmarkAddConcurrent(t *testing.T) {
+	s := newBookmarkStore()
+	s.set(&Bookmark{URL: "gemini://example.org/", Label: "Example", Folder: "Reading", Tags: []string{"tag"}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			s.add("gemini://example.org/", fmt.Sprintf("Label %d", i))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			s.add(fmt.Sprintf("gemini://example.org/%d", i), "")
+		}(i)
+	}
+	wg.Wait()
+
+	b, ok := s.get("gemini://example.org/")
+	if !ok || b.Folder != "Reading" || len(b.Tags) != 1 || b.Tags[0] != "tag" {
+		t.Errorf("expected folder and tags to be kept, got %+v", b)
+	}
+
+	// Bookmarks added concurrently to the same folder have unique positions.
+	positions := make(map[int]bool)
+	for _, b := range s.entries() {
+		if b.Folder != "" {
+			continue
+		} else if positions[b.Position] {
+			t.Errorf("position %d is used by several bookmarks", b.Position)
+		}
+		positions[b.Position] = true
+	}
+}
+
+func TestBookmarkReplace(t *testing.T) {
+	s := newBookmarkStore()
+	s.replace([]*Bookmark{
+		{URL: "gemini://example.org/c", Label: "C"},
+		{URL: "gemini://example.org/x", Label: "X", Folder: "/Reading/"},
+		{URL: "gemini://example.org/a", Label: "A"},
+		{URL: "gemini://example.org/y", Label: "Y", Folder: "Reading"},
+		{URL: "Gemini://Example.org/c", Label: "C again"},
+		{URL: "gemini://example.org/b", Label: "B"},
+	})
+
+	var order []string
+	for _, b := range s.entries() {
+		order = append(order, fmt.Sprintf("%s/%s:%d", b.Folder, b.Label, b.Position))
+	}
+	expected := []string{"/C again:0", "/A:1", "/B:2", "Reading/X:0", "Reading/Y:1"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+}
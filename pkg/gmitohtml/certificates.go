@@ -0,0 +1,54 @@
+package gmitohtml
+
+import (
+	"crypto/tls"
+	"sort"
+	"sync"
+)
+
+// certStore holds client certificates by domain. It is safe for concurrent
+// use.
+type certStore struct {
+	certs map[string]tls.Certificate
+	sync.RWMutex
+}
+
+func newCertStore() *certStore {
+	return &certStore{
+		certs: make(map[string]tls.Certificate),
+	}
+}
+
+func (s *certStore) get(domain string) (tls.Certificate, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	cert, ok := s.certs[domain]
+	return cert, ok
+}
+
+func (s *certStore) set(domain string, cert tls.Certificate) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.certs[domain] = cert
+}
+
+func (s *certStore) remove(domain string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.certs, domain)
+}
+
+func (s *certStore) domains() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	domains := make([]string, 0, len(s.certs))
+	for domain := range s.certs {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
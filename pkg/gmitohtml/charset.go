@@ -0,0 +1,61 @@
+package gmitohtml
+
+import (
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// mediaType returns the media type and parameters of a success response
+// header. When no media type is specified, text/gemini is assumed. Invalid
+// parameters are ignored.
+func mediaType(header []byte) (string, map[string]string) {
+	var meta string
+	if len(header) > 3 {
+		meta = strings.TrimSpace(string(header[3:]))
+	}
+	if meta == "" {
+		return "text/gemini", map[string]string{}
+	}
+
+	mimeType, params, err := mime.ParseMediaType(meta)
+	if err != nil {
+		mimeType = strings.ToLower(strings.TrimSpace(strings.SplitN(meta, ";", 2)[0]))
+		params = map[string]string{}
+	}
+	return mimeType, params
+}
+
+// charsetDecoder returns a decoder transcoding a character encoding to
+// UTF-8. Encodings are identified by the labels recognized by web browsers
+// (e.g. iso-8859-1, shift_jis or koi8-r). No decoder is returned for UTF-8.
+func charsetDecoder(charset string) (*encoding.Decoder, error) {
+	e, err := htmlindex.Get(strings.TrimSpace(charset))
+	if err != nil {
+		return nil, err
+	}
+	if name, _ := htmlindex.Name(e); name == "utf-8" {
+		return nil, nil
+	}
+	return e.NewDecoder(), nil
+}
+
+// decodeCharset transcodes text to UTF-8. The text is returned unmodified
+// when the encoding is unknown.
+func decodeCharset(data []byte, charset string) []byte {
+	if charset == "" {
+		return data
+	}
+
+	decoder, err := charsetDecoder(charset)
+	if err != nil || decoder == nil {
+		return data
+	}
+	decoded, err := decoder.Bytes(data)
+	if err != nil {
+		return data
+	}
+	return decoded
+}
@@ -0,0 +1,167 @@
+package gmitohtml
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Policies for serving content received from Gemini servers which may
+// contain scripts (e.g. HTML and SVG), or is of an unknown type.
+const (
+	// ContentPolicySandbox serves content with a sandbox Content Security
+	// Policy, which prevents scripts from running and from accessing pages
+	// served by the daemon.
+	ContentPolicySandbox = "sandbox"
+
+	// ContentPolicyAttachment serves content as a download.
+	ContentPolicyAttachment = "attachment"
+
+	// ContentPolicyOrigin serves content without restriction from a separate
+	// origin, specified via DaemonOptions.ContentOrigin.
+	ContentPolicyOrigin = "origin"
+)
+
+// pagePolicy is the Content Security Policy of pages generated by the daemon.
+// Pages are styled with water.css, which has always been loaded from
+// jsDelivr rather than bundled, so that it receives fixes without a new
+// release. Only stylesheets of water.css may be loaded from there, which can
+// not run scripts, and pages remain usable with the bundled style.css when
+// the CDN is unreachable or blocked.
+const pagePolicy = "default-src 'none'; style-src 'self' https://cdn.jsdelivr.net/npm/water.css@2/; img-src 'self' data:; media-src 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// sandboxPolicy is the Content Security Policy of content received from
+// Gemini servers.
+const sandboxPolicy = "sandbox; default-src 'none'; style-src 'unsafe-inline' data:; img-src data:; media-src data:; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+// passiveTypes are the types of content received from Gemini servers which
+// may be displayed without restriction.
+var passiveTypes = []string{
+	"text/plain",
+	"image/bmp",
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"image/webp",
+	"audio/",
+	"video/",
+}
+
+// setSecurityHeaders sets the headers of pages generated by the daemon.
+func setSecurityHeaders(header http.Header) {
+	header.Set("Content-Security-Policy", pagePolicy)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("Referrer-Policy", "no-referrer")
+	header.Set("Cross-Origin-Opener-Policy", "same-origin")
+}
+
+// passiveType returns whether content of the specified type may be displayed
+// without restriction.
+func passiveType(mediaType string) bool {
+	for _, t := range passiveTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentOrigin returns the parsed origin content is served from when the
+// content policy is ContentPolicyOrigin, or nil.
+func (o *DaemonOptions) contentOrigin() *url.URL {
+	if o.ContentPolicy != ContentPolicyOrigin || o.ContentOrigin == "" {
+		return nil
+	}
+	origin, err := url.Parse(o.ContentOrigin)
+	if err != nil || origin.Host == "" {
+		return nil
+	}
+	return origin
+}
+
+// isContentOrigin returns whether a request was sent to the origin content is
+// served from.
+func (d *Daemon) isContentOrigin(request *http.Request) bool {
+	options := d.getOptions()
+	origin := options.contentOrigin()
+	return origin != nil && strings.EqualFold(origin.Host, request.Host)
+}
+
+// writeContent writes content received from a Gemini server, which is not
+// converted. Content which may contain scripts is served according to the
+// content policy.
+func (d *Daemon) writeContent(writer http.ResponseWriter, request *http.Request, contentType string, r io.Reader) {
+	if d.contentHeader(writer, request, contentType) {
+		io.Copy(writer, r)
+	}
+}
+
+// contentHeader sets the header of content which is not converted, according
+// to the content policy. It returns false when the content must not be
+// written, because a redirect or an error was written instead.
+func (d *Daemon) contentHeader(writer http.ResponseWriter, request *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+		contentType = mediaType
+	}
+
+	header := writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Security-Policy", sandboxPolicy)
+
+	if passiveType(mediaType) {
+		return true
+	}
+
+	options := d.getOptions()
+	switch options.ContentPolicy {
+	case ContentPolicyAttachment:
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, strings.ReplaceAll(path.Base(request.URL.Path), `"`, "")))
+	case ContentPolicyOrigin:
+		origin := options.contentOrigin()
+		if origin == nil {
+			http.Error(writer, "Error: content origin is not configured", http.StatusInternalServerError)
+			return false
+		} else if !d.isContentOrigin(request) {
+			redirect := *request.URL
+			redirect.Scheme = origin.Scheme
+			redirect.Host = origin.Host
+			redirect.Path = d.pagePath(request.URL.Path)
+			redirect.RawPath = ""
+			http.Redirect(writer, request, redirect.String(), http.StatusSeeOther)
+			return false
+		}
+
+		// Content served from a separate origin can not access the daemon.
+		header.Del("Content-Security-Policy")
+	}
+	return true
+}
+
+// isContentPath returns whether a path is handled by the handler serving
+// content received from Gemini servers, or local files.
+func (d *Daemon) isContentPath(p string) bool {
+	d.configLock.RLock()
+	handler := d.handler
+	d.configLock.RUnlock()
+
+	_, pattern := handler.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: p}})
+	return pattern == "/" || pattern == "/file/"
+}
+
+// redirectToMain redirects a request sent to the content origin to the URL
+// the daemon is reachable at.
+func (d *Daemon) redirectToMain(writer http.ResponseWriter, request *http.Request) {
+	baseURL := d.baseURL()
+	if baseURL == "" {
+		http.Error(writer, "Error: pages are not served from the content origin", http.StatusForbidden)
+		return
+	}
+	http.Redirect(writer, request, baseURL+request.URL.RequestURI(), http.StatusSeeOther)
+}
@@ -0,0 +1,157 @@
+package gmitohtml
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// contentResponses are the responses of the Gemini server started by
+// testContentServer, by path.
+var contentResponses = map[string]string{
+	"/page.gmi":   "20 text/gemini\r\n# Page\n",
+	"/page.html":  "20 text/html\r\n<script>alert(1)</script>",
+	"/image.svg":  "20 image/svg+xml\r\n<svg><script>alert(1)</script></svg>",
+	"/image.png":  "20 image/png\r\n\x89PNG",
+	"/text.txt":   "20 text/plain\r\n<script>alert(1)</script>",
+	"/invalid":    "20 \x00\r\n<script>alert(1)</script>",
+	"/notfound":   "51 Not found\r\n",
+	"/unexpected": "99 Unexpected\r\n",
+}
+
+// testContentServer starts a Gemini server responding with contentResponses.
+func testContentServer(t testing.TB) string {
+	return testGeminiServer(t, func(w io.Writer, request string) {
+		for p, response := range contentResponses {
+			if strings.HasSuffix(request, p) {
+				io.WriteString(w, response)
+				return
+			}
+		}
+		io.WriteString(w, "51 Not found\r\n")
+	})
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	d := testDaemon(testContentServer(t), nil)
+
+	tests := []struct {
+		path   string
+		policy string
+	}{
+		{"/page.gmi", pagePolicy},
+		{"/notfound", pagePolicy},
+		{"/unexpected", pagePolicy},
+		{"/page.html", sandboxPolicy},
+		{"/image.svg", sandboxPolicy},
+		{"/image.png", sandboxPolicy},
+		{"/text.txt", sandboxPolicy},
+		{"/invalid", sandboxPolicy},
+		{"/bookmarks", pagePolicy},
+	}
+	for _, test := range tests {
+		w := serve(d, "GET", test.path, nil, nil)
+		header := w.Header()
+		if policy := header.Get("Content-Security-Policy"); policy != test.policy {
+			t.Errorf("%s: expected Content-Security-Policy %q, got %q", test.path, test.policy, policy)
+		}
+		if nosniff := header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+			t.Errorf("%s: expected X-Content-Type-Options nosniff, got %q", test.path, nosniff)
+		}
+		if frame := header.Get("X-Frame-Options"); frame != "DENY" {
+			t.Errorf("%s: expected X-Frame-Options DENY, got %q", test.path, frame)
+		}
+	}
+
+	w := serve(d, "GET", "/invalid", nil, nil)
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/octet-stream" {
+		t.Errorf("expected invalid content type to be replaced, got %q", contentType)
+	}
+}
+
+func TestContentPolicy(t *testing.T) {
+	address := testContentServer(t)
+
+	tests := []struct {
+		name        string
+		options     DaemonOptions
+		host        string
+		path        string
+		status      int
+		policy      string
+		disposition bool
+		location    string
+	}{
+		{"sandbox", DaemonOptions{}, "localhost", "/page.html", http.StatusOK, sandboxPolicy, false, ""},
+		{"sandbox passive", DaemonOptions{}, "localhost", "/image.png", http.StatusOK, sandboxPolicy, false, ""},
+		{"attachment", DaemonOptions{ContentPolicy: ContentPolicyAttachment}, "localhost", "/page.html", http.StatusOK, sandboxPolicy, true, ""},
+		{"attachment passive", DaemonOptions{ContentPolicy: ContentPolicyAttachment}, "localhost", "/image.png", http.StatusOK, sandboxPolicy, false, ""},
+		{"origin", DaemonOptions{ContentPolicy: ContentPolicyOrigin, ContentOrigin: "http://content.localhost"}, "localhost", "/image.svg", http.StatusSeeOther, sandboxPolicy, false, "http://content.localhost/image.svg"},
+		{"origin content", DaemonOptions{ContentPolicy: ContentPolicyOrigin, ContentOrigin: "http://content.localhost"}, "content.localhost", "/image.svg", http.StatusOK, "", false, ""},
+		{"origin page", DaemonOptions{ContentPolicy: ContentPolicyOrigin, ContentOrigin: "http://content.localhost", BaseURL: "http://localhost"}, "content.localhost", "/page.gmi", http.StatusSeeOther, pagePolicy, false, "http://localhost/page.gmi"},
+		{"origin page without base URL", DaemonOptions{ContentPolicy: ContentPolicyOrigin, ContentOrigin: "http://content.localhost"}, "content.localhost", "/page.gmi", http.StatusForbidden, pagePolicy, false, ""},
+		{"origin not configured", DaemonOptions{ContentPolicy: ContentPolicyOrigin}, "localhost", "/page.html", http.StatusInternalServerError, sandboxPolicy, false, ""},
+	}
+	for _, test := range tests {
+		options := test.options
+		d := testDaemon(address, &options)
+
+		w := serveFrom(d, "GET", test.path, test.host, nil, nil, nil)
+		header := w.Header()
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body.String())
+		}
+		if policy := header.Get("Content-Security-Policy"); policy != test.policy {
+			t.Errorf("%s: expected Content-Security-Policy %q, got %q", test.name, test.policy, policy)
+		}
+		if nosniff := header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+			t.Errorf("%s: expected X-Content-Type-Options nosniff, got %q", test.name, nosniff)
+		}
+		if disposition := header.Get("Content-Disposition") != ""; disposition != test.disposition {
+			t.Errorf("%s: expected Content-Disposition: %v, got %q", test.name, test.disposition, header.Get("Content-Disposition"))
+		}
+		if location := header.Get("Location"); location != test.location {
+			t.Errorf("%s: expected redirect to %q, got %q", test.name, test.location, location)
+		}
+	}
+}
+
+func TestContentPolicyFile(t *testing.T) {
+	root, _ := testFileRoot(t)
+	err := ioutil.WriteFile(filepath.Join(root, "page.html"), []byte("<script>alert(1)</script>"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(&DaemonOptions{AllowFile: true, FileRoots: []string{root}, ContentPolicy: ContentPolicyAttachment})
+
+	tests := []struct {
+		path        string
+		policy      string
+		disposition bool
+	}{
+		{"/page.gmi", pagePolicy, false},
+		{"/text.txt", sandboxPolicy, false},
+		{"/page.html", sandboxPolicy, true},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "http://localhost/file"+root+test.path, nil)
+		request.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, request)
+
+		header := w.Header()
+		if policy := header.Get("Content-Security-Policy"); policy != test.policy {
+			t.Errorf("%s: expected Content-Security-Policy %q, got %q", test.path, test.policy, policy)
+		}
+		if nosniff := header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+			t.Errorf("%s: expected X-Content-Type-Options nosniff, got %q", test.path, nosniff)
+		}
+		if disposition := header.Get("Content-Disposition") != ""; disposition != test.disposition {
+			t.Errorf("%s: expected Content-Disposition: %v, got %q", test.path, test.disposition, header.Get("Content-Disposition"))
+		}
+	}
+}
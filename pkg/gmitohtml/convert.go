@@ -5,33 +5,87 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"html"
+	"html/template"
+	"io"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma"
 )
 
 // ErrInvalidURL is the error returned when the URL is invalid.
 var ErrInvalidURL = errors.New("invalid URL")
 
-var daemonAddress string
-var hostAddress string
-
 var assetLock sync.Mutex
 
-func rewriteURL(u string, loc *url.URL) string {
-	if daemonAddress != "" {
+// maxLineLength is the maximum length of a line of a text/gemini document.
+// Lines are only limited by available memory.
+const maxLineLength = int(^uint(0) >> 1)
+
+// newLineScanner returns a scanner reading the lines of a text/gemini
+// document. Unlike the default scanner, lines of any length are read.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	return scanner
+}
+
+// validUTF8 returns a line with invalid UTF-8 sequences replaced with the
+// Unicode replacement character.
+func validUTF8(line []byte) []byte {
+	if utf8.Valid(line) {
+		return line
+	}
+	return bytes.ToValidUTF8(line, []byte("\uFFFD"))
+}
+
+// unsafeSchemes are the schemes of links which may run scripts.
+var unsafeSchemes = []string{"javascript:", "vbscript:", "data:"}
+
+// safeURL returns a link, or "#" when the link may run scripts. Browsers
+// ignore leading control characters and spaces, and tabs and newlines
+// anywhere in a URL.
+func safeURL(u string) string {
+	normalized := strings.TrimLeftFunc(u, func(r rune) bool {
+		return r <= ' '
+	})
+	normalized = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, normalized)
+	normalized = strings.ToLower(normalized)
+
+	for _, scheme := range unsafeSchemes {
+		if strings.HasPrefix(normalized, scheme) {
+			return "#"
+		}
+	}
+	return u
+}
+
+// rewriteURL rewrites a link to be served by the daemon. Links are returned
+// unmodified when d is nil.
+func (d *Daemon) rewriteURL(u string, loc *url.URL) string {
+	if d != nil {
+		baseURL := d.baseURL()
+
 		scheme := "gemini"
-		if strings.HasPrefix(loc.Path, "/file/") {
+		if loc != nil && loc.Scheme == "file" {
 			scheme = "file"
 		}
 
 		if strings.HasPrefix(u, "file://") {
-			if !allowFileAccess {
-				return "http://" + daemonAddress + "/?FileAccessNotAllowed"
+			if !d.getOptions().AllowFile {
+				return baseURL + "/?FileAccessNotAllowed"
 			}
-			return "http://" + daemonAddress + "/file/" + u[7:]
+			return baseURL + "/file/" + strings.TrimPrefix(u[7:], "/")
 		}
 
 		offset := 0
@@ -44,122 +98,454 @@ func rewriteURL(u string, loc *url.URL) string {
 		}
 
 		if strings.HasPrefix(u, "gemini://") {
-			return "http://" + u[9:]
+			options := d.getOptions()
+			return options.scheme() + "://" + u[9:]
 		} else if strings.Contains(u, "://") {
 			return u
 		} else if loc != nil && len(u) > 0 && !strings.HasPrefix(u, "//") {
 			if u[0] != '/' {
-				if loc.Path[len(loc.Path)-1] == '/' {
+				if loc.Path == "" || loc.Path[len(loc.Path)-1] == '/' {
 					u = path.Join("/", loc.Path, u)
 				} else {
 					u = path.Join("/", path.Dir(loc.Path), u)
 				}
 			}
 
-			result := "http://" + daemonAddress + u
+			if scheme == "file" {
+				return baseURL + "/file" + u
+			}
+			result := baseURL + u
 			return result
 		}
-		return "http://" + daemonAddress + "/" + scheme + "/" + u
+		return baseURL + "/" + scheme + "/" + u
 	}
 	return u
 }
 
-func newPage() []byte {
-	data := []byte(pageHeader)
-	// if daemonAddress != "" {
-	// 	data = append(data, navHeader...)
-	// }
-	return append(data, contentHeader...)
+// ConvertOptions are options for converting text/gemini to text/html.
+type ConvertOptions struct {
+	// URL is the URL of the document, used to resolve relative links.
+	URL string
+
+	// Charset is the character encoding of the document, which is
+	// transcoded to UTF-8. When empty, UTF-8 is assumed. Documents in an
+	// unknown encoding are converted as UTF-8 and include a notice.
+	Charset string
+
+	// Lang is the language of the document, as specified by the lang
+	// parameter of the text/gemini media type (e.g. fr or en,fr). Documents
+	// in right-to-left languages are displayed right to left.
+	Lang string
+
+	// CollapsePreformatted displays preformatted text collapsed, with its
+	// alt text as summary.
+	CollapsePreformatted bool
+
+	// Highlight highlights the syntax of preformatted text labeled with a
+	// language as alt text (e.g. go). Highlighted text is styled by
+	// HighlightCSS, which is included in the page when converting a
+	// document without a daemon.
+	Highlight bool
+
+	// HeadingAnchors adds a link to each level one to three heading, which
+	// may be used to link to the section. Headings always have an id.
+	HeadingAnchors bool
+
+	// TableOfContents inserts a table of contents after the first heading
+	// of documents with more than the specified number of headings. When
+	// zero, no table of contents is inserted. The document is converted
+	// into memory before it is written.
+	TableOfContents int
+
+	// Title is the title of the document. When empty, the text of the first
+	// heading is used.
+	Title string
+
+	// EmbedMedia displays links to images, audio and video as embedded
+	// media, captioned with the link. Media is loaded lazily. When
+	// converting a document without a daemon, only relative and HTTP(S)
+	// links are embedded.
+	EmbedMedia bool
+
+	// MediaType returns the media type of the content a link resolved
+	// against URL refers to, or an empty string when it is unknown. When
+	// nil or unknown, the media type is determined by the file extension.
+	MediaType func(u string) string
+}
+
+// convertOptions returns the options pages served by the daemon are
+// converted with.
+func (o *DaemonOptions) convertOptions(u string) *ConvertOptions {
+	return &ConvertOptions{
+		URL:                  u,
+		CollapsePreformatted: o.CollapsePreformatted,
+		Highlight:            o.Highlight,
+		HeadingAnchors:       o.HeadingAnchors,
+		TableOfContents:      o.TableOfContents,
+		EmbedMedia:           o.EmbedMedia,
+	}
+}
+
+// artWords are the words marking preformatted text with alt text as art
+// (e.g. ASCII art), which is presented to screen readers as an image
+// described by the alt text.
+var artWords = []string{"art", "banner", "diagram", "drawing", "logo"}
+
+// isArt returns whether preformatted text with the specified alt text is
+// art.
+func isArt(alt string) bool {
+	words := strings.FieldsFunc(strings.ToLower(alt), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, word := range words {
+		for _, artWord := range artWords {
+			if word == artWord {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// Convert converts text/gemini to text/html.
+// Convert converts text/gemini to text/html. Use ConvertStream to convert a
+// document read from an io.Reader and receive read and write errors.
 func Convert(page []byte, u string) []byte {
-	var result []byte
+	var b bytes.Buffer
+	ConvertStream(&b, bytes.NewReader(page), &ConvertOptions{URL: u}) // Writing to a buffer always succeeds
+	return b.Bytes()
+}
+
+// ConvertStream converts text/gemini read from r to text/html written to w.
+// The document is converted line by line, without reading it into memory.
+// Each line of text is converted to a paragraph, and adjacent links to a
+// list, within an article.
+// Lines may be of any length. Errors reading from r or writing to w are
+// returned.
+func ConvertStream(w io.Writer, r io.Reader, opts *ConvertOptions) error {
+	_, err := (*Daemon)(nil).convert(w, r, nil, "", opts)
+	return err
+}
+
+// convert converts text/gemini to a text/html page. Links are rewritten to be
+// served by the daemon, unless d is nil. Pages with a request token include
+// a button toggling media embedding when the navigation bar is shown. The
+// metadata of the page is returned once it has been read, even when the
+// remainder of the document can not be converted.
+func (d *Daemon) convert(w io.Writer, r io.Reader, p *Profile, token string, opts *ConvertOptions) (*Metadata, error) {
+	if opts == nil {
+		opts = &ConvertOptions{}
+	}
+
+	data := d.newPageData(p, opts.URL, false, token, nil)
+	if data.NavigationBar && token != "" {
+		data.MediaToggle = d.mediaToggle(token, opts)
+	}
+	data.Lang, data.Dir = pageLanguage(opts.Lang)
+	data.Highlight = opts.Highlight
+	if opts.Charset != "" {
+		decoder, err := charsetDecoder(opts.Charset)
+		if err != nil {
+			data.Notice = fmt.Sprintf("This page uses an unknown character encoding (%s) and may not display correctly.", opts.Charset)
+		} else if decoder != nil {
+			r = decoder.Reader(r)
+		}
+	}
 
-	var preformatted bool
+	loc, err := url.Parse(opts.URL)
+	if err != nil {
+		loc = nil
+	} else if loc.Scheme == "gemini" {
+		data.Canonical = template.URL(loc.String())
+	}
+
+	// The metadata is read from the start of the document, which is
+	// converted once the page header is written.
+	scanner := newLineScanner(r)
+	meta := &metadataParser{meta: &Metadata{Title: opts.Title}}
+	var head [][]byte
+	for len(head) < maxMetadataLines && scanner.Scan() {
+		line := append([]byte(nil), validUTF8(scanner.Bytes())...)
+		head = append(head, line)
+		if meta.line(line) {
+			break
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	data.Metadata = meta.meta
 
-	parsedURL, err := url.Parse(u)
+	bw := bufio.NewWriter(w)
+	err = convertedPageTemplate.ExecuteTemplate(bw, "header", data)
 	if err != nil {
-		parsedURL = nil
-		err = nil
+		return data.Metadata, err
 	}
+	bw.WriteString("\n<article>\n")
 
-	scanner := bufio.NewScanner(bytes.NewReader(page))
+	c := &converter{
+		d:    d,
+		w:    bw,
+		loc:  loc,
+		opts: opts,
+	}
+	for _, line := range head {
+		c.line(line)
+	}
 	for scanner.Scan() {
-		line := scanner.Bytes()
-		l := len(line)
-		if l >= 3 && string(line[0:3]) == "```" {
-			preformatted = !preformatted
-			if preformatted {
-				result = append(result, []byte("<pre>\n")...)
-			} else {
-				result = append(result, []byte("</pre>\n")...)
-			}
-			continue
+		c.line(validUTF8(scanner.Bytes()))
+	}
+	err = scanner.Err()
+	if err != nil {
+		return data.Metadata, err
+	}
+	c.finish()
+
+	bw.WriteString("</article>\n")
+	err = convertedPageTemplate.ExecuteTemplate(bw, "footer", data)
+	if err != nil {
+		return data.Metadata, err
+	}
+	return data.Metadata, bw.Flush()
+}
+
+// converter converts the lines of a text/gemini document to text/html.
+type converter struct {
+	d    *Daemon
+	w    *bufio.Writer
+	loc  *url.URL
+	opts *ConvertOptions
+
+	links        bool
+	preformatted bool
+	alt          string
+
+	// lexer highlights the current block of preformatted text, which is
+	// buffered in code until the block ends.
+	lexer chroma.Lexer
+	code  bytes.Buffer
+
+	// ids are the ids of headings, and idSuffixes the number last appended
+	// to each id to make it unique. When a table of contents is inserted,
+	// headings are listed and the document following the first heading is
+	// written to rest until the end of the document.
+	ids        map[string]bool
+	idSuffixes map[string]int
+	headings   []*headingEntry
+	out        *bufio.Writer
+	rest       *bytes.Buffer
+}
+
+// line converts a single line. Each line of text is a paragraph, and
+// adjacent links are listed together.
+func (c *converter) line(line []byte) {
+	w := c.w
+	l := len(line)
+	if l >= 3 && line[0] == '`' && line[1] == '`' && line[2] == '`' {
+		if c.preformatted {
+			c.endPreformatted()
+		} else {
+			c.endLinks()
+			c.startPreformatted(string(bytes.TrimSpace(line[3:])))
 		}
+		return
+	}
 
-		if preformatted {
-			result = append(result, html.EscapeString(string(line))...)
-			result = append(result, []byte("\n")...)
-			continue
+	if c.preformatted {
+		if c.lexer != nil {
+			c.code.Write(line)
+			c.code.WriteByte('\n')
+			return
 		}
+		template.HTMLEscape(w, line)
+		w.WriteByte('\n')
+		return
+	}
 
-		if l >= 6 && bytes.HasPrefix(line, []byte("=>")) {
-			splitStart := 2
-			if line[splitStart] == ' ' || line[splitStart] == '\t' {
-				splitStart++
-			}
+	if l >= 6 && line[0] == '=' && line[1] == '>' {
+		splitStart := 2
+		if line[splitStart] == ' ' || line[splitStart] == '\t' {
+			splitStart++
+		}
 
-			var split [][]byte
-			firstSpace := bytes.IndexRune(line[splitStart:], ' ')
-			firstTab := bytes.IndexRune(line[splitStart:], '\t')
-			if firstSpace != -1 && (firstTab == -1 || firstSpace < firstTab) {
-				split = bytes.SplitN(line[splitStart:], []byte(" "), 2)
-			} else if firstTab != -1 {
-				split = bytes.SplitN(line[splitStart:], []byte("\t"), 2)
-			}
+		linkURL := line[splitStart:]
+		linkLabel := linkURL
+		if i := bytes.IndexAny(linkURL, " \t"); i != -1 {
+			linkURL, linkLabel = linkURL[:i], linkURL[i+1:]
+		}
 
-			var linkURL []byte
-			var linkLabel []byte
-			if len(split) == 2 {
-				linkURL = split[0]
-				linkLabel = split[1]
-			} else {
-				linkURL = line[splitStart:]
-				linkLabel = line[splitStart:]
-			}
-			link := append([]byte(`<a href="`), html.EscapeString(rewriteURL(string(linkURL), parsedURL))...)
-			link = append(link, []byte(`">`)...)
-			link = append(link, html.EscapeString(string(linkLabel))...)
-			link = append(link, []byte(`</a>`)...)
-			result = append(result, link...)
-			result = append(result, []byte("<br>")...)
-			continue
-		}
-
-		heading := 0
-		for i := 0; i < l; i++ {
-			if line[i] == '#' {
-				heading++
-			} else {
-				break
+		if c.opts.EmbedMedia {
+			if element := c.linkMedia(string(linkURL)); element != "" {
+				c.endLinks()
+				c.embedMedia(element, linkURL, linkLabel)
+				return
 			}
 		}
-		if heading > 0 {
-			result = append(result, []byte(fmt.Sprintf("<h%d>%s</h%d>", heading, html.EscapeString(string(line[heading:])), heading))...)
-			continue
+
+		if !c.links {
+			w.WriteString("<ul>\n")
+			c.links = true
 		}
+		w.WriteString(`<li><a href="`)
+		template.HTMLEscape(w, []byte(safeURL(c.d.rewriteURL(string(linkURL), c.loc))))
+		w.WriteString(`">`)
+		template.HTMLEscape(w, linkLabel)
+		w.WriteString("</a></li>\n")
+		return
+	}
+	c.endLinks()
 
-		result = append(result, html.EscapeString(string(line))...)
-		result = append(result, []byte("<br>")...)
+	// HTML has six levels of headings.
+	heading := 0
+	for heading < l && heading < 6 && line[heading] == '#' {
+		heading++
+	}
+	if heading > 0 {
+		c.heading(heading, line[heading:])
+		return
 	}
 
-	if preformatted {
-		result = append(result, []byte("</pre>\n")...)
+	// Blank lines separate paragraphs, which are already spaced apart.
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
 	}
 
-	data := newPage()
-	data = append(data, result...)
-	data = append(data, []byte(pageFooter)...)
-	return fillTemplateVariables(data, u, false)
+	w.WriteString("<p>")
+	template.HTMLEscape(w, line)
+	w.WriteString("</p>\n")
+}
+
+// endLinks ends a list of links.
+func (c *converter) endLinks() {
+	if c.links {
+		c.w.WriteString("</ul>\n")
+		c.links = false
+	}
+}
+
+// startPreformatted starts a block of preformatted text. Alt text is
+// provided as a label and caption, or as summary when the block is
+// collapsed.
+func (c *converter) startPreformatted(alt string) {
+	w := c.w
+	c.preformatted = true
+	c.alt = alt
+	c.lexer = nil
+	if c.opts.Highlight {
+		c.lexer = highlightLexer(alt)
+	}
+
+	if c.opts.CollapsePreformatted {
+		summary := alt
+		if summary == "" {
+			summary = "Preformatted text"
+		}
+		w.WriteString("<details><summary>")
+		template.HTMLEscape(w, []byte(summary))
+		w.WriteString("</summary>")
+	} else if alt != "" {
+		w.WriteString("<figure>")
+	}
+
+	w.WriteString("<pre")
+	if c.lexer != nil {
+		w.WriteString(` class="chroma"`)
+	}
+	if alt != "" {
+		if isArt(alt) {
+			w.WriteString(` role="img"`)
+		}
+		w.WriteString(` aria-label="`)
+		template.HTMLEscape(w, []byte(alt))
+		w.WriteString(`"`)
+	}
+	w.WriteString(">\n")
+}
+
+// endPreformatted ends a block of preformatted text.
+func (c *converter) endPreformatted() {
+	w := c.w
+	c.preformatted = false
+
+	if c.lexer != nil {
+		err := highlight(w, c.lexer, c.code.String())
+		if err != nil {
+			template.HTMLEscape(w, c.code.Bytes())
+		}
+		c.code.Reset()
+	}
+	w.WriteString("</pre>")
+	if c.opts.CollapsePreformatted {
+		w.WriteString("</details>")
+	} else if c.alt != "" {
+		w.WriteString("<figcaption>")
+		template.HTMLEscape(w, []byte(c.alt))
+		w.WriteString("</figcaption></figure>")
+	}
+	w.WriteString("\n")
+}
+
+// heading converts a heading. Level one to three headings have an id and
+// are listed in the table of contents.
+func (c *converter) heading(level int, text []byte) {
+	w := c.w
+	if level > 3 {
+		w.WriteString("<h")
+		w.WriteString(strconv.Itoa(level))
+		w.WriteByte('>')
+		template.HTMLEscape(w, text)
+		w.WriteString("</h")
+		w.WriteString(strconv.Itoa(level))
+		w.WriteString(">\n")
+		return
+	}
+
+	id := c.headingID(string(text))
+	w.WriteString("<h")
+	w.WriteString(strconv.Itoa(level))
+	w.WriteString(` id="`)
+	template.HTMLEscape(w, []byte(id))
+	w.WriteString(`">`)
+	template.HTMLEscape(w, text)
+	if c.opts.HeadingAnchors {
+		w.WriteString(` <a href="#`)
+		template.HTMLEscape(w, []byte(id))
+		w.WriteString(`" class="anchor" aria-label="Link to this section">#</a>`)
+	}
+	w.WriteString("</h")
+	w.WriteString(strconv.Itoa(level))
+	w.WriteString(">\n")
+
+	if c.opts.TableOfContents <= 0 {
+		return
+	}
+	c.headings = append(c.headings, &headingEntry{
+		level: level,
+		id:    id,
+		text:  strings.TrimSpace(string(text)),
+	})
+	if c.rest == nil {
+		// The table of contents is inserted after the first heading.
+		c.out = w
+		c.rest = &bytes.Buffer{}
+		c.w = bufio.NewWriter(c.rest)
+	}
+}
+
+// finish closes elements left open at the end of the document and inserts
+// the table of contents.
+func (c *converter) finish() {
+	if c.preformatted {
+		c.endPreformatted()
+	}
+	c.endLinks()
+
+	if c.rest != nil {
+		c.w.Flush() // Writing to a buffer always succeeds
+		c.w = c.out
+		if len(c.headings) > c.opts.TableOfContents {
+			writeTableOfContents(c.w, c.headings[1:])
+		}
+		c.w.Write(c.rest.Bytes())
+	}
 }
@@ -0,0 +1,149 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var errTest = errors.New("test error")
+
+// errReader returns an error once its data has been read.
+type errReader struct {
+	r io.Reader
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		return n, errTest
+	}
+	return n, err
+}
+
+// errWriter returns an error on every write.
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errTest
+}
+
+func TestConvertStreamLongLine(t *testing.T) {
+	for _, prefix := range []string{"", "# ", "=> gemini://example.org/ ", "```\n"} {
+		long := strings.Repeat("a", 256*1024)
+		page := prefix + long + "\n## End\n"
+
+		var b bytes.Buffer
+		err := ConvertStream(&b, strings.NewReader(page), nil)
+		if err != nil {
+			t.Fatalf("prefix %q: unexpected error: %s", prefix, err)
+		}
+		out := b.String()
+		i := strings.Index(out, long)
+		if i == -1 {
+			t.Errorf("prefix %q: long line was truncated", prefix)
+		} else if !strings.Contains(out[i+len(long):], "End") {
+			t.Errorf("prefix %q: lines after the long line were not converted", prefix)
+		}
+	}
+}
+
+func TestConvertStreamInvalidInput(t *testing.T) {
+	pages := []string{
+		"text\x00with NUL\n",
+		"text \xff\xfe invalid\n",
+		"# heading \x00\xc3\n",
+		"=> gemini://example.org/\x00\xff label \xc3\x28\n",
+		"```alt \x00\xff\ncode \x00\xe2\x82\n```\n",
+		"\xef\xbb\xbf\x00\n\xff",
+	}
+	for _, page := range pages {
+		var b bytes.Buffer
+		err := ConvertStream(&b, strings.NewReader(page+"last line\n"), nil)
+		if err != nil {
+			t.Fatalf("page %q: unexpected error: %s", page, err)
+		}
+		out := b.Bytes()
+		if bytes.IndexByte(out, 0) != -1 {
+			t.Errorf("page %q: output contains NUL", page)
+		}
+		if !utf8.Valid(out) {
+			t.Errorf("page %q: output is not valid UTF-8", page)
+		}
+		if !bytes.Contains(out, []byte("last line")) {
+			t.Errorf("page %q: lines after invalid input were not converted", page)
+		}
+	}
+}
+
+func TestConvertStreamReadError(t *testing.T) {
+	pages := []string{
+		"",
+		"# Title\n",
+		strings.Repeat("line\n", 2*maxMetadataLines),
+		strings.Repeat("a", 256*1024),
+	}
+	for _, page := range pages {
+		err := ConvertStream(ioutil.Discard, &errReader{strings.NewReader(page)}, nil)
+		if err != errTest {
+			t.Errorf("page of %d bytes: expected read error, got %v", len(page), err)
+		}
+	}
+}
+
+func TestConvertStreamWriteError(t *testing.T) {
+	page := strings.Repeat("line\n", 10000)
+	err := ConvertStream(errWriter{}, strings.NewReader(page), nil)
+	if err == nil {
+		t.Error("expected write error")
+	}
+}
+
+// benchmarkPage returns a gemtext document of at least size bytes, mixing
+// headings, text, links, lists, quotes and preformatted text.
+func benchmarkPage(size int) []byte {
+	const block = "# Heading\n" +
+		"A paragraph of text with <markup> & entities, long enough to be representative of prose.\n" +
+		"\n" +
+		"=> gemini://example.org/some/path Link label\n" +
+		"=> relative/page.gmi Relative link\n" +
+		"* List item\n" +
+		"> Quoted text\n" +
+		"```alt text\n" +
+		"preformatted <code>\n" +
+		"```\n"
+
+	var b bytes.Buffer
+	for b.Len() < size {
+		b.WriteString(block)
+	}
+	return b.Bytes()
+}
+
+func BenchmarkConvert(b *testing.B) {
+	page := benchmarkPage(4 << 20)
+	b.SetBytes(int64(len(page)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Convert(page, "gemini://example.org/index.gmi")
+	}
+}
+
+func BenchmarkConvertStream(b *testing.B) {
+	page := benchmarkPage(4 << 20)
+	opts := &ConvertOptions{URL: "gemini://example.org/index.gmi"}
+	b.SetBytes(int64(len(page)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := ConvertStream(ioutil.Discard, bytes.NewReader(page), opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
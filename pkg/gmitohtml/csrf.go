@@ -0,0 +1,187 @@
+package gmitohtml
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// sessionCookie is the name of the cookie identifying a browser session.
+const sessionCookie = "gmitohtml_session"
+
+// csrfField is the name of the form field containing the request token.
+const csrfField = "csrf"
+
+// ErrInvalidRequest is the error returned when a request changing state is
+// not submitted via POST with a valid request token from the same origin.
+var ErrInvalidRequest = errors.New("invalid request")
+
+// newKey returns a random key request tokens or login cookie signatures are
+// derived from. Separate keys are used for each purpose.
+func newKey() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate key: %s", err))
+	}
+	return key
+}
+
+// session returns the session identifier of a request. When the request
+// has no session, a new session is started.
+func (d *Daemon) session(writer http.ResponseWriter, request *http.Request) string {
+	cookie, err := request.Cookie(sessionCookie)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	id := make([]byte, 32)
+	_, err = rand.Read(id)
+	if err != nil {
+		panic(fmt.Sprintf("failed to generate session: %s", err))
+	}
+	session := base64.RawURLEncoding.EncodeToString(id)
+
+	options := d.getOptions()
+	http.SetCookie(writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session,
+		Path:     d.pagePath("/"),
+		HttpOnly: true,
+		Secure:   options.tlsEnabled(),
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// Make the session available to handlers called later in this request.
+	request.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	return session
+}
+
+// requestToken returns the token of a session.
+func (d *Daemon) requestToken(session string) string {
+	mac := hmac.New(sha256.New, d.csrfKey)
+	mac.Write([]byte(session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyRequest returns an error unless a request was submitted via POST
+// from a page served by the daemon, with a valid request token.
+func (d *Daemon) verifyRequest(request *http.Request) error {
+	if request.Method != http.MethodPost {
+		return ErrInvalidRequest
+	}
+
+	origin := request.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		origin = request.Header.Get("Referer")
+	}
+	if origin != "" {
+		originURL, err := url.Parse(origin)
+		if err != nil || !d.sameOrigin(request, originURL) {
+			return ErrInvalidRequest
+		}
+	}
+
+	cookie, err := request.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return ErrInvalidRequest
+	}
+	token := request.PostFormValue(csrfField)
+	if !hmac.Equal([]byte(token), []byte(d.requestToken(cookie.Value))) {
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
+// writeInvalidRequest writes an error explaining that a request was refused.
+func writeInvalidRequest(writer http.ResponseWriter) {
+	http.Error(writer, "Error: invalid request. Reload the page and try again.", http.StatusForbidden)
+}
+
+// sameOrigin returns whether the origin a request was submitted from is the
+// daemon. Reverse proxies may change the host of requests, so the origin may
+// also be the host of BaseURL or one of the hosts the daemon is known to be
+// reachable at. Pages served from the content origin are never the same
+// origin.
+func (d *Daemon) sameOrigin(request *http.Request, origin *url.URL) bool {
+	if strings.EqualFold(origin.Host, request.Host) {
+		return true
+	}
+
+	options := d.getOptions()
+	if contentOrigin := options.contentOrigin(); contentOrigin != nil && strings.EqualFold(contentOrigin.Host, origin.Host) {
+		return false
+	}
+	if base, err := url.Parse(d.baseURL()); err == nil && base.Host != "" && strings.EqualFold(base.Host, origin.Host) {
+		return true
+	}
+	return d.knownHost(strings.ToLower(origin.Hostname()))
+}
+
+// knownHost returns whether a hostname is one of the hosts the daemon is
+// reachable at, as specified in AllowedHosts, BaseURL or Address. The host
+// of the Gemini server pages are requested from is also allowed, as the
+// daemon is often served via the same hostname.
+func (d *Daemon) knownHost(host string) bool {
+	options := d.getOptions()
+	for _, allowed := range options.AllowedHosts {
+		if matchHost(allowed, host) {
+			return true
+		}
+	}
+
+	if parsed, err := url.Parse(d.baseURL()); err == nil && parsed.Hostname() != "" && strings.EqualFold(parsed.Hostname(), host) {
+		return true
+	}
+	if hostname, _, err := splitHostPort(options.Hostname); err == nil && hostname != "" && strings.EqualFold(hostname, host) {
+		return true
+	}
+	return false
+}
+
+// maxWarnedHosts is the maximum number of rejected hosts a warning is
+// logged for.
+const maxWarnedHosts = 100
+
+// allowedHost returns whether the host a request was sent to is one the
+// daemon is reachable at. This prevents other websites from accessing the
+// daemon via DNS rebinding. IP addresses, localhost and the content origin
+// are always allowed, as well as the hosts allowed by knownHost. A warning
+// is logged the first time a request to another host is refused.
+func (d *Daemon) allowedHost(request *http.Request) bool {
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if net.ParseIP(host) != nil || host == "localhost" {
+		return true
+	}
+
+	options := d.getOptions()
+	if origin := options.contentOrigin(); origin != nil && strings.EqualFold(origin.Hostname(), host) {
+		return true
+	}
+	if d.knownHost(host) {
+		return true
+	}
+
+	d.warnedHostsLock.Lock()
+	warn := !d.warnedHosts[host] && len(d.warnedHosts) < maxWarnedHosts
+	if warn {
+		d.warnedHosts[host] = true
+	}
+	d.warnedHostsLock.Unlock()
+	if warn {
+		log.Printf("refused request sent to host %q: add it to AllowedHosts when the daemon is reachable via this host", host)
+	}
+	return false
+}
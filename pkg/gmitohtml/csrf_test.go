@@ -0,0 +1,159 @@
+package gmitohtml
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// serveFrom serves a request sent to a host, with the specified headers.
+func serveFrom(d *Daemon, method string, target string, host string, header http.Header, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	request := httptest.NewRequest(method, "http://"+host+target, body)
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, request)
+	return w
+}
+
+func TestRequestToken(t *testing.T) {
+	d := NewDaemon(&DaemonOptions{Bookmarks: true})
+	cookie, token := testSession(t, d)
+	otherCookie, _ := testSession(t, d)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		token  string
+		status int
+	}{
+		{"valid token", cookie, token, http.StatusSeeOther},
+		{"no token", cookie, "", http.StatusForbidden},
+		{"invalid token", cookie, "invalid", http.StatusForbidden},
+		{"token of other session", otherCookie, token, http.StatusForbidden},
+		{"no session", nil, token, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		form := url.Values{"address": {"gemini://example.org/" + strings.ReplaceAll(test.name, " ", "-")}}
+		if test.token != "" {
+			form.Set(csrfField, test.token)
+		}
+		w := serve(d, "POST", "/bookmarks", test.cookie, form)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+		}
+		_, added := d.GetBookmarks()[form.Get("address")]
+		if added != (test.status == http.StatusSeeOther) {
+			t.Errorf("%s: bookmark added: %v", test.name, added)
+		}
+	}
+}
+
+func TestRequestRequiresPost(t *testing.T) {
+	d := NewDaemon(&DaemonOptions{Bookmarks: true, EmbedMedia: true})
+	cookie, token := testSession(t, d)
+
+	// State is only changed via POST.
+	w := serve(d, "GET", "/media?"+url.Values{csrfField: {token}, "url": {"gemini://example.org/"}, "embed": {"0"}}.Encode(), cookie, nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected media toggle via GET to be refused, got %d", w.Code)
+	}
+	if !d.profile.media.embed("gemini://example.org/", true) {
+		t.Error("media embedding was changed via GET")
+	}
+
+	serve(d, "GET", "/bookmarks?"+url.Values{csrfField: {token}, "address": {"gemini://example.org/get"}}.Encode(), cookie, nil)
+	if _, ok := d.GetBookmarks()["gemini://example.org/get"]; ok {
+		t.Error("bookmark was added via GET")
+	}
+
+	w = serve(d, "POST", "/media", cookie, url.Values{csrfField: {token}, "url": {"gemini://example.org/"}, "embed": {"0"}})
+	if w.Code != http.StatusSeeOther || d.profile.media.embed("gemini://example.org/", true) {
+		t.Errorf("expected media toggle via POST to succeed, got %d", w.Code)
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		options DaemonOptions
+		host    string
+		header  http.Header
+		status  int
+	}{
+		{"no origin", DaemonOptions{}, "localhost", nil, http.StatusSeeOther},
+		{"same origin", DaemonOptions{}, "localhost", http.Header{"Origin": {"http://localhost"}}, http.StatusSeeOther},
+		{"same referer", DaemonOptions{}, "localhost", http.Header{"Referer": {"http://localhost/bookmarks"}}, http.StatusSeeOther},
+		{"other origin", DaemonOptions{}, "localhost", http.Header{"Origin": {"http://evil.example"}}, http.StatusForbidden},
+		{"other port", DaemonOptions{}, "localhost:8080", http.Header{"Origin": {"http://localhost:9090"}}, http.StatusForbidden},
+		{"other referer", DaemonOptions{}, "localhost", http.Header{"Origin": {"null"}, "Referer": {"http://evil.example/"}}, http.StatusForbidden},
+		{"invalid origin", DaemonOptions{}, "localhost", http.Header{"Origin": {"http://%zz"}}, http.StatusForbidden},
+		{"proxied to base URL", DaemonOptions{BaseURL: "https://gemini.example.org"}, "127.0.0.1:8080", http.Header{"Origin": {"https://gemini.example.org"}}, http.StatusSeeOther},
+		{"proxied to allowed host", DaemonOptions{AllowedHosts: []string{"*.example.org"}}, "127.0.0.1:8080", http.Header{"Origin": {"https://gemini.example.org"}}, http.StatusSeeOther},
+		{"proxied from other origin", DaemonOptions{BaseURL: "https://gemini.example.org"}, "127.0.0.1:8080", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{"content origin", DaemonOptions{ContentPolicy: ContentPolicyOrigin, ContentOrigin: "http://content.localhost:8081", AllowedHosts: []string{"*.localhost"}}, "localhost:8080", http.Header{"Origin": {"http://content.localhost:8081"}}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		options := test.options
+		options.Bookmarks = true
+		d := NewDaemon(&options)
+		cookie, token := testSession(t, d)
+
+		w := serveFrom(d, "POST", "/bookmarks", test.host, test.header, cookie, url.Values{csrfField: {token}, "address": {"gemini://example.org/"}})
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAllowedHost(t *testing.T) {
+	tests := []struct {
+		options DaemonOptions
+		host    string
+		allowed bool
+	}{
+		{DaemonOptions{}, "localhost", true},
+		{DaemonOptions{}, "localhost:8080", true},
+		{DaemonOptions{}, "127.0.0.1:8080", true},
+		{DaemonOptions{}, "[::1]:8080", true},
+		{DaemonOptions{}, "192.168.1.2", true},
+		{DaemonOptions{}, "evil.example", false},
+		{DaemonOptions{}, "localhost.evil.example", false},
+		{DaemonOptions{Address: ":8080"}, "example.org:8080", false},
+		{DaemonOptions{Address: "example.org:8080"}, "example.org:8080", true},
+		{DaemonOptions{Address: "example.org:8080"}, "evil.example:8080", false},
+		{DaemonOptions{BaseURL: "https://Gemini.Example.org/"}, "gemini.example.org", true},
+		{DaemonOptions{BaseURL: "https://gemini.example.org/"}, "example.org", false},
+		{DaemonOptions{Address: ":8080", Hostname: "example.org"}, "example.org", true},
+		{DaemonOptions{Address: ":8080", Hostname: "example.org:1966"}, "example.org", true},
+		{DaemonOptions{AllowedHosts: []string{"*.example.org"}}, "gemini.example.org", true},
+		{DaemonOptions{AllowedHosts: []string{"*.example.org"}}, "example.org", false},
+		{DaemonOptions{ContentPolicy: ContentPolicyOrigin, ContentOrigin: "http://content.example.org"}, "content.example.org", true},
+	}
+	for _, test := range tests {
+		options := test.options
+		d := NewDaemon(&options)
+
+		w := serveFrom(d, "GET", "/", test.host, nil, nil, nil)
+		if test.allowed && w.Code == http.StatusMisdirectedRequest {
+			t.Errorf("%+v: expected host %s to be allowed", test.options, test.host)
+		} else if !test.allowed && w.Code != http.StatusMisdirectedRequest {
+			t.Errorf("%+v: expected host %s to be refused, got %d", test.options, test.host, w.Code)
+		}
+	}
+}
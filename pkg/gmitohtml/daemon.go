@@ -1,75 +1,458 @@
 package gmitohtml
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"html"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"path"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var lastRequestTime = time.Now().Unix()
+// DaemonOptions are the options of the page conversion daemon.
+type DaemonOptions struct {
+	// Address is the address the daemon listens on. Unix domain sockets are
+	// specified as unix: followed by the path of the socket. When set to
+	// systemd, the socket passed via systemd socket activation is used.
+	Address string
+
+	// BaseURL is the URL the daemon is reachable at (e.g. when it is served
+	// behind a reverse proxy). When empty, http:// or https:// followed by
+	// the daemon address is used, or relative links when listening on a
+	// Unix domain socket or a socket passed by systemd. The daemon may be
+	// served below a path (e.g. https://example.org/gemini/), in which case
+	// requests are expected to include the path, which is removed before
+	// they are handled (e.g. when registered with an http.ServeMux as
+	// /gemini/). Requests outside of the path are not served.
+	BaseURL string
+
+	// CertFile and KeyFile are the certificate and private key requests are
+	// served with via HTTPS. When unset, requests are served via HTTP.
+	CertFile string
+	KeyFile  string
+
+	// SelfSigned serves requests via HTTPS using a self-signed certificate.
+	// When CertFile and KeyFile are set and do not exist, the generated
+	// certificate is saved to them and reused on subsequent starts.
+	SelfSigned bool
+
+	// Hostname is the Gemini server pages are requested from, optionally
+	// followed by a port. When empty, pages are requested from localhost on
+	// the default Gemini port.
+	Hostname string
+
+	// AllowFile allows local file access via file://. Files are served at
+	// /file/ followed by the path of the file.
+	AllowFile bool
+
+	// FileRoots are the directories local files may be served from. Files
+	// outside of these directories, including files linked to via symbolic
+	// links, are not served. When empty, the current working directory is
+	// used.
+	FileRoots []string
+
+	// AllowRemoteFile allows local file access by clients connecting from
+	// other machines. By default, local files are only served to clients
+	// connecting via a loopback address or a Unix domain socket. When the
+	// daemon is served behind a reverse proxy on the same machine, the proxy
+	// must provide the address of clients in the Forwarded, X-Forwarded-For
+	// or X-Real-IP header, or all clients are considered local.
+	AllowRemoteFile bool
+
+	// AddressBar shows an address bar at the top of each page.
+	AddressBar bool
+
+	// NavigationBar shows links to bookmarks, subscriptions and history at
+	// the top of each page, when enabled.
+	NavigationBar bool
+
+	// Bookmarks enables bookmarks. Bookmarks are listed on the index page
+	// and may be managed at /bookmarks.
+	Bookmarks bool
+
+	// Subscriptions enables subscriptions, which are updated in the
+	// background. The timeline of all subscriptions is shown, and
+	// subscriptions may be managed, at /subscriptions.
+	Subscriptions bool
+
+	// History shows the history of visited pages at /history, where it may
+	// be searched and deleted. History is only recorded when enabled via
+	// EnableHistory.
+	History bool
+
+	// Feeds serves Atom and RSS feeds of gemlogs at /feed.
+	Feeds bool
+
+	// CollapsePreformatted displays preformatted text collapsed, with its
+	// alt text as summary.
+	CollapsePreformatted bool
+
+	// Highlight highlights the syntax of preformatted text labeled with a
+	// language as alt text (e.g. go).
+	Highlight bool
+
+	// HeadingAnchors adds a link to each heading, which may be used to link
+	// to the section.
+	HeadingAnchors bool
+
+	// TableOfContents inserts a table of contents after the first heading
+	// of pages with more than the specified number of headings. When zero,
+	// no table of contents is inserted.
+	TableOfContents int
+
+	// EmbedMedia displays links to images, audio and video as embedded
+	// media. Media embedding may be toggled on each page via the navigation
+	// bar.
+	EmbedMedia bool
+
+	// SniffMedia determines whether links are embedded as media by the type
+	// of the content they refer to when it has been fetched by the daemon,
+	// rather than by their file extension.
+	SniffMedia bool
+
+	// Access restricts the servers the daemon connects to.
+	Access AccessPolicy
+
+	// ContentPolicy specifies how content received from Gemini servers which
+	// may contain scripts (e.g. HTML and SVG), or is of an unknown type, is
+	// served. When empty, ContentPolicySandbox is used.
+	ContentPolicy string
+
+	// ContentOrigin is the URL of the separate origin content is served from
+	// when ContentPolicy is ContentPolicyOrigin (e.g.
+	// https://content.example.org). The daemon must also be reachable at
+	// this URL, which must not share cookies with the daemon.
+	ContentOrigin string
+
+	// AllowedHosts are the hosts the daemon may be accessed via, in
+	// addition to the host of BaseURL or Address, the host of Hostname, IP
+	// addresses and localhost. Hosts are specified as described in
+	// AccessPolicy. Requests sent to other hosts are refused, which prevents
+	// other websites from accessing the daemon via DNS rebinding.
+	AllowedHosts []string
+
+	// Authentication specifies how users are authenticated, either
+	// AuthenticationPassword or AuthenticationHeader. Each user has a
+	// separate profile. When empty, requests are not authenticated and all
+	// clients share the default profile.
+	Authentication string
+
+	// PasswordFile is the file containing the users and their bcrypt
+	// password hashes when Authentication is AuthenticationPassword. Each
+	// line contains a user name and hash separated by a colon, as created
+	// by htpasswd -B. Users may be managed via SetPassword and RemoveUser.
+	PasswordFile string
+
+	// LoginKeyFile is the file containing the key login cookies are signed
+	// with. When the file does not exist, a random key is generated and
+	// saved to it, so users stay signed in when the daemon is restarted.
+	// When empty, a random key is generated when the daemon is created.
+	LoginKeyFile string
+
+	// UserHeader is the header a reverse proxy provides the name of the
+	// authenticated user in when Authentication is AuthenticationHeader.
+	// When empty, DefaultUserHeader is used.
+	UserHeader string
+
+	// TrustedProxies are the IP addresses and networks (e.g. 10.0.0.0/8)
+	// UserHeader is accepted from. When empty, only loopback addresses are
+	// trusted. Requests received via a Unix domain socket are always
+	// trusted.
+	TrustedProxies []string
+
+	// Admins are the users allowed to manage users at /admin.
+	Admins []string
+}
 
-var (
-	clientCerts        = make(map[string]tls.Certificate)
-	bookmarks          = make(map[string]string)
-	bookmarksSorted    []string
-	allowFileAccess    bool
-	onBookmarksChanged func()
-)
+// Daemon is a page conversion daemon. Daemon implements http.Handler, and
+// may be served via ListenAndServe or mounted into an existing server.
+// Multiple daemons may run independently of each other.
+type Daemon struct {
+	options    DaemonOptions
+	handler    *http.ServeMux
+	configLock sync.RWMutex
+
+	server     *http.Server
+	serverLock sync.Mutex
+
+	lastRequestTime int64 // Accessed atomically
+
+	csrfKey  []byte
+	loginKey []byte
+
+	users  *userStore
+	logins *loginLimiter
+
+	warnedHosts     map[string]bool
+	warnedHostsLock sync.Mutex
+
+	profile          *Profile
+	profiles         map[string]*Profile
+	onProfileCreated func(p *Profile)
+	onProfileRemoved func(p *Profile)
+	profileLock      sync.Mutex
+
+	pollInterval time.Duration
+	polling      bool
+	stopPolling  chan struct{}
+	pollLock     sync.Mutex
+}
+
+var assetsOnce sync.Once
+
+// defaultDaemon is the daemon controlled by the package-level functions.
+var defaultDaemon = NewDaemon(nil)
+
+// NewDaemon returns a new page conversion daemon.
+func NewDaemon(options *DaemonOptions) *Daemon {
+	d := &Daemon{
+		lastRequestTime: time.Now().Unix(),
+		csrfKey:         newKey(),
+		loginKey:        newKey(),
+		users:           newUserStore(),
+		logins:          newLoginLimiter(),
+		warnedHosts:     make(map[string]bool),
+		profiles:        make(map[string]*Profile),
+		pollInterval:    DefaultSubscriptionInterval,
+	}
+	d.profile = newProfile(d, "")
+	d.configure(options)
+	d.addDefaultBookmarks()
+	return d
+}
+
+// addDefaultBookmarks adds the default bookmarks to the default profile when
+// bookmarks are enabled and there are none. This is only done when the
+// daemon is created or started, and not when it is reconfigured, so
+// bookmarks loaded afterwards (e.g. from a configuration file) are not
+// replaced.
+func (d *Daemon) addDefaultBookmarks() {
+	if !d.getOptions().Bookmarks || len(d.profile.bookmarks.entries()) != 0 {
+		return
+	}
+	for u, label := range defaultBookmarks {
+		d.AddBookmark(u, label)
+	}
+}
+
+func (d *Daemon) configure(options *DaemonOptions) {
+	if options == nil {
+		options = &DaemonOptions{}
+	}
+
+	assetsOnce.Do(loadAssets)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/assets/style.css", handleAssets)
+	handler.HandleFunc("/assets/highlight.css", handleAssets)
+	if options.Authentication != "" {
+		handler.HandleFunc("/admin", d.handleAdmin)
+		handler.HandleFunc("/login", d.handleLogin)
+		handler.HandleFunc("/logout", d.handleLogout)
+	}
+	if options.Bookmarks {
+		handler.HandleFunc("/bookmarks", d.handleBookmarks)
+	}
+	if options.Feeds {
+		handler.HandleFunc("/feed", d.handleFeed)
+	}
+	handler.HandleFunc("/file/", d.handleFile)
+	if options.History {
+		handler.HandleFunc("/history", d.handleHistory)
+	}
+	handler.HandleFunc("/knownhosts", d.handleKnownHosts)
+	handler.HandleFunc("/media", d.handleMedia)
+	if options.Subscriptions {
+		handler.HandleFunc("/subscriptions", d.handleSubscriptions)
+	}
+	handler.HandleFunc("/", d.handleRequest)
+
+	// The login key generated when the daemon is created is used when no
+	// key file is specified, or it cannot be loaded.
+	var loginKey []byte
+	if options.LoginKeyFile != "" {
+		key, err := loadLoginKey(options.LoginKeyFile)
+		if err != nil {
+			log.Printf("failed to load login key: %s", err)
+		} else {
+			loginKey = key
+		}
+	}
+
+	d.configLock.Lock()
+	d.options = *options
+	d.handler = handler
+	if loginKey != nil {
+		d.loginKey = loginKey
+	}
+	d.configLock.Unlock()
+}
+
+// getOptions returns a copy of the daemon options.
+func (d *Daemon) getOptions() DaemonOptions {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+
+	return d.options
+}
+
+// baseURL returns the URL the daemon is reachable at.
+func (d *Daemon) baseURL() string {
+	options := d.getOptions()
+	if options.BaseURL != "" {
+		return strings.TrimSuffix(options.BaseURL, "/")
+	} else if options.Address != "" && options.Address != systemdAddress && !strings.HasPrefix(options.Address, unixAddressPrefix) {
+		return options.scheme() + "://" + options.Address
+	}
+	return ""
+}
+
+// basePath returns the path the daemon is served at, without a trailing
+// slash. An empty string is returned when it is served at the root path, or
+// when d is nil.
+func (d *Daemon) basePath() string {
+	if d == nil {
+		return ""
+	}
+	options := d.getOptions()
+	if options.BaseURL == "" {
+		return ""
+	}
+	u, err := url.Parse(options.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
 
-var defaultBookmarks = map[string]string{
-	"gemini://gemini.circumlunar.space/": "Project Gemini",
-	"gemini://gus.guru/":                 "GUS - Gemini Universal Search",
+// pagePath returns a path on the daemon, below the path it is served at.
+func (d *Daemon) pagePath(p string) string {
+	return d.basePath() + p
+}
+
+// URL returns the URL the daemon is reachable at, or an empty string when
+// it is unknown.
+func (d *Daemon) URL() string {
+	return d.baseURL()
 }
 
 // ErrInvalidCertificate is the error returned when an invalid certificate is provided.
 var ErrInvalidCertificate = errors.New("invalid certificate")
 
-func bookmarksList() []byte {
-	fakeURL, _ := url.Parse("/") // Always succeeds
+// ErrResponseTooLarge is the error returned when a Gemini server sends a
+// response larger than maxResponseSize.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// ErrInvalidHeader is the error returned when a Gemini server sends a
+// response without a header terminated by CRLF.
+var ErrInvalidHeader = errors.New("invalid response header")
+
+// defaultHostname is the Gemini server pages are requested from when no
+// hostname is specified.
+const defaultHostname = "localhost"
 
-	var b bytes.Buffer
-	b.Write([]byte(`<ul>`))
-	for _, u := range bookmarksSorted {
-		b.Write([]byte(fmt.Sprintf(`<li><a href="%s">%s</a></li>`, rewriteURL(u, fakeURL), bookmarks[u])))
+const (
+	// dialTimeout is the maximum time to wait for a connection to a Gemini
+	// server to be established.
+	dialTimeout = 30 * time.Second
+
+	// requestTimeout is the maximum time to wait for a Gemini server to send
+	// a complete response, including the time to connect.
+	requestTimeout = 2 * time.Minute
+
+	// maxResponseSize is the maximum size of a response received from a
+	// Gemini server, including the header.
+	maxResponseSize = 64 << 20
+)
+
+// responseBody is the body of a Gemini response, which is read from the
+// connection as it is received. Reading more than the remaining size of the
+// response returns ErrResponseTooLarge.
+type responseBody struct {
+	r    io.Reader
+	n    int64 // Bytes remaining
+	conn net.Conn
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		var extra [1]byte
+		n, err := io.ReadFull(b.r, extra[:])
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
 	}
-	b.Write([]byte("</ul>"))
-	return b.Bytes()
+	n, err := b.r.Read(p)
+	b.n -= int64(n)
+	return n, err
+}
+
+// Close closes the connection the response is received from.
+func (b *responseBody) Close() error {
+	return b.conn.Close()
 }
 
-// fetch downloads and converts a Gemini page.
-func fetch(u string) ([]byte, []byte, error) {
+// fetchResponse requests a Gemini resource using the client certificates of
+// a profile and returns the parsed request URL, the response header and the
+// response body, which is read from the connection and must be closed.
+func (d *Daemon) fetchResponse(p *Profile, u string) (*url.URL, []byte, io.ReadCloser, error) {
 	if u == "" {
-		return nil, nil, ErrInvalidURL
+		return nil, nil, nil, ErrInvalidURL
 	}
 
 	requestURL, err := url.ParseRequestURI(u)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	if requestURL.Scheme == "" {
 		requestURL.Scheme = "gemini"
 	}
 
-	host := requestURL.Host
-	if strings.IndexRune(host, ':') == -1 {
-		host += ":1965"
+	hostname, port, err := splitHostPort(requestURL.Host)
+	if err != nil {
+		return nil, nil, nil, err
+	} else if hostname == "" {
+		return nil, nil, nil, ErrInvalidURL
 	}
 
+	access := d.getOptions().Access
+	err = access.checkHost(hostname, port)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	knownHost := net.JoinHostPort(hostname, strconv.Itoa(port))
 	tlsConfig := &tls.Config{
-		// This must be enabled until most sites have transitioned away from
-		// using self-signed certificates.
+		// Most sites use self-signed certificates, which are trusted on
+		// first use instead of being verified against certificate
+		// authorities.
 		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrInvalidCertificate
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			return p.knownHosts.verify(knownHost, cert)
+		},
 	}
 
 	certHost := requestURL.Hostname()
@@ -77,188 +460,203 @@ func fetch(u string) ([]byte, []byte, error) {
 		certHost = certHost[4:]
 	}
 
-	clientCert, certAvailable := clientCerts[certHost]
+	clientCert, certAvailable := p.clientCerts.get(certHost)
 	if certAvailable {
 		tlsConfig.Certificates = []tls.Certificate{clientCert}
 	}
 
-	conn, err := tls.Dial("tcp", host, tlsConfig)
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+		Control: access.dialControl,
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", knownHost, tlsConfig)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
 	// Send request header
 	conn.Write([]byte(requestURL.String() + "\r\n"))
 
-	data, err := ioutil.ReadAll(conn)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	firstNewLine := -1
-	l := len(data)
-	if l > 2 {
-		for i := 1; i < l; i++ {
-			if data[i] == '\n' && data[i-1] == '\r' {
-				firstNewLine = i
-				break
-			}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadSlice('\n')
+	if err != nil || !bytes.HasSuffix(line, []byte("\r\n")) {
+		conn.Close()
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return nil, nil, nil, err
 		}
+		return nil, nil, nil, ErrInvalidHeader
 	}
-	var header []byte
-	if firstNewLine > -1 {
-		header = data[:firstNewLine]
-		data = data[firstNewLine+1:]
-	}
-
-	requestInput := bytes.HasPrefix(header, []byte("1"))
-	if requestInput {
-		requestSensitiveInput := bytes.HasPrefix(header, []byte("11"))
-
-		data = newPage()
-
-		data = append(data, []byte(inputPrompt)...)
-
-		data = bytes.Replace(data, []byte("~GEMINIINPUTFORM~"), []byte(html.EscapeString(rewriteURL(u, requestURL))), 1)
+	header := append([]byte(nil), validUTF8(line[:len(line)-2])...)
 
-		prompt := "(No input prompt)"
-		if len(header) > 3 {
-			prompt = string(header[3:])
-		}
-		data = bytes.Replace(data, []byte("~GEMINIINPUTPROMPT~"), []byte(prompt), 1)
-
-		inputType := "text"
-		if requestSensitiveInput {
-			inputType = "password"
-		}
-		data = bytes.Replace(data, []byte("~GEMINIINPUTTYPE~"), []byte(inputType), 1)
+	body := &responseBody{
+		r:    r,
+		n:    maxResponseSize - int64(len(line)),
+		conn: conn,
+	}
+	return requestURL, header, body, nil
+}
 
-		return header, fillTemplateVariables(data, u, false), nil
+// fetch requests a Gemini page and returns the response header and body,
+// which must be closed. Pages with an unexpected header are rendered as an
+// error page. When the server asks for input, no body is returned, as the
+// input prompt is rendered by the handler.
+func (d *Daemon) fetch(p *Profile, u string) ([]byte, io.ReadCloser, error) {
+	_, header, body, err := d.fetchResponse(p, u)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if !bytes.HasPrefix(header, []byte("2")) {
-		errorPage := newPage()
-		errorPage = append(errorPage, []byte(fmt.Sprintf("Server sent unexpected header:<br><br><b>%s</b>", header))...)
-		errorPage = append(errorPage, []byte(pageFooter)...)
-		return header, fillTemplateVariables(errorPage, u, false), nil
+	if bytes.HasPrefix(header, []byte("1")) {
+		body.Close()
+		return header, nil, nil
 	}
 
-	if bytes.HasPrefix(header, []byte("20 text/html")) {
-		return header, data, nil
+	if !bytes.HasPrefix(header, []byte("2")) {
+		body.Close()
+		page := d.renderPage(unexpectedHeaderTemplate, p, u, false, "", string(header))
+		return header, ioutil.NopCloser(bytes.NewReader(page)), nil
 	}
-	return header, Convert(data, requestURL.String()), nil
+	return header, body, nil
 }
 
-func handleIndex(writer http.ResponseWriter, request *http.Request) {
+func (d *Daemon) handleIndex(writer http.ResponseWriter, request *http.Request) {
 	address := request.FormValue("address")
 	if address != "" {
-		http.Redirect(writer, request, rewriteURL(address, request.URL), http.StatusSeeOther)
+		http.Redirect(writer, request, d.rewriteURL(address, request.URL), http.StatusSeeOther)
 		return
 	}
 
-	page := newPage()
-	// page = append(page, bookmarksList()...)
-	page = append(page, pageFooter...)
-
-	writer.Write(fillTemplateVariables(page, request.URL.String(), true))
-}
-
-func fillTemplateVariables(data []byte, currentURL string, autofocus bool) []byte {
-	if strings.HasPrefix(currentURL, "gemini://") {
-		currentURL = currentURL[9:]
-	}
-	if currentURL == "/" {
-		currentURL = ""
-	}
-	data = bytes.ReplaceAll(data, []byte("~GEMINICURRENTURL~"), []byte(currentURL))
-
-	autofocusValue := ""
-	if autofocus {
-		autofocusValue = "autofocus"
+	var bookmarks []*Bookmark
+	if d.getOptions().Bookmarks {
+		bookmarks = d.requestProfile(request).bookmarks.entries()
 	}
-	data = bytes.ReplaceAll(data, []byte("~GEMINIAUTOFOCUS~"), []byte(autofocusValue))
-
-	return data
+	d.writePage(writer, request, indexTemplate, request.URL.String(), true, bookmarks)
 }
 
-func handleRequest(writer http.ResponseWriter, request *http.Request) {
+func (d *Daemon) handleRequest(writer http.ResponseWriter, request *http.Request) {
 	defer request.Body.Close()
 
-	lastRequestTime = time.Now().Unix()
+	atomic.StoreInt64(&d.lastRequestTime, time.Now().Unix())
 
 	if request.URL == nil {
 		return
 	}
 
 	if request.URL.Path == "/" {
-		handleIndex(writer, request)
+		d.handleIndex(writer, request)
 		return
 	}
 
 	pathSplit := strings.Split(request.URL.Path, "/")
-	// if len(pathSplit) < 2 || (pathSplit[1] != "gemini" && (!allowFileAccess || pathSplit[1] != "file")) {
-	// 	writer.Write([]byte("Error: invalid protocol, only Gemini is supported"))
-	// 	return
-	// }
 
 	scheme := "gemini://"
-	// if pathSplit[1] == "file" {
-	// 	scheme = "file://"
-	// }
 
 	//TODO: take an input here for where to send the request somewhere else if needed
-	u, err := url.ParseRequestURI(scheme + hostAddress + strings.Join(pathSplit[0:], "/"))
+	options := d.getOptions()
+
+	hostname := options.Hostname
+	if hostname == "" {
+		hostname = defaultHostname
+	}
+
+	u, err := url.ParseRequestURI(scheme + hostname + strings.Join(pathSplit[0:], "/"))
 	if err != nil {
-		writer.Write([]byte("Error: invalid URL"))
+		http.Error(writer, "Error: invalid URL", http.StatusBadRequest)
 		return
 	}
 	if request.URL.RawQuery != "" {
 		u.RawQuery = request.URL.RawQuery
 	}
 
-	inputText := request.PostFormValue("input")
-	if inputText != "" {
-		u.RawQuery = inputText
-		http.Redirect(writer, request, rewriteURL(u.String(), u), http.StatusSeeOther)
+	if request.Method == http.MethodPost {
+		if d.verifyRequest(request) != nil {
+			writeInvalidRequest(writer)
+			return
+		}
+
+		u.RawQuery = request.PostFormValue("input")
+		http.Redirect(writer, request, d.rewriteURL(u.String(), u), http.StatusSeeOther)
 		return
 	}
 
-	var header []byte
-	var data []byte
-	if scheme == "gemini://" {
-		header, data, err = fetch(u.String())
-		if err != nil {
-			fmt.Fprintf(writer, "Error: failed to fetch %s: %s", u, err)
-			return
-		}
-	} else if allowFileAccess && scheme == "file://" {
-		header = []byte("20 text/gemini; charset=utf-8")
-		data, err = ioutil.ReadFile(path.Join("/", strings.Join(pathSplit[2:], "/")))
-		if err != nil {
-			fmt.Fprintf(writer, "Error: failed to read file %s: %s", u, err)
-			return
-		}
-		data = Convert(data, u.String())
-	} else {
-		writer.Write([]byte("Error: invalid URL"))
+	p := d.requestProfile(request)
+	header, body, err := d.fetch(p, u.String())
+	if errors.Is(err, ErrAccessDenied) {
+		d.writeAccessDenied(writer, request, u.String(), err)
+		return
+	} else if errors.Is(err, ErrCertificateChanged) {
+		d.writeCertificateChanged(writer, request, u.String(), err)
 		return
+	} else if err != nil {
+		http.Error(writer, fmt.Sprintf("Error: failed to fetch %s: %s", u, err), http.StatusBadGateway)
+		return
+	}
+	if body != nil {
+		defer body.Close()
 	}
 
-	if len(header) > 0 && header[0] == '3' {
+	if len(header) > 0 && header[0] == '1' {
+		prompt := "(No input prompt)"
+		if len(header) > 3 {
+			prompt = string(header[3:])
+		}
+		inputType := "text"
+		if bytes.HasPrefix(header, []byte("11")) {
+			inputType = "password"
+		}
+
+		d.writePage(writer, request, inputPromptTemplate, u.String(), false, &struct {
+			Action    string
+			Prompt    string
+			InputType string
+		}{
+			Action:    d.rewriteURL(u.String(), u),
+			Prompt:    prompt,
+			InputType: inputType,
+		})
+		return
+	} else if len(header) > 0 && header[0] == '3' {
+		// Redirects to links which may run scripts are not followed.
 		split := bytes.SplitN(header, []byte(" "), 2)
 		if len(split) == 2 {
-			http.Redirect(writer, request, rewriteURL(string(split[1]), u), http.StatusSeeOther)
-			return
+			if target := d.rewriteURL(string(split[1]), u); safeURL(target) == target {
+				http.Redirect(writer, request, target, http.StatusSeeOther)
+				return
+			}
 		}
 	}
 
-	if len(header) > 3 && !bytes.HasPrefix(header[3:], []byte("text/gemini")) {
-		writer.Header().Set("Content-Type", string(header[3:]))
-	} else {
-		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	mimeType, params := mediaType(header)
+	if len(header) > 0 && header[0] == '2' {
+		d.recordMediaType(p, u.String(), mimeType)
+	}
+	if len(header) > 3 && header[0] == '2' && mimeType != "text/gemini" {
+		d.writeContent(writer, request, string(header[3:]), body)
+		return
+	} else if d.isContentOrigin(request) {
+		d.redirectToMain(writer, request)
+		return
 	}
 
-	writer.Write(data)
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if len(header) == 0 || header[0] != '2' {
+		io.Copy(writer, body)
+		return
+	}
+
+	convertOptions := options.convertOptions(u.String())
+	convertOptions.Charset = params["charset"]
+	convertOptions.Lang = params["lang"]
+	d.mediaOptions(convertOptions, p)
+	meta, err := d.convert(writer, body, p, d.requestToken(d.session(writer, request)), convertOptions)
+	if meta != nil {
+		p.history.add(u.String(), meta.Title)
+	}
+	if err != nil {
+		log.Printf("failed to convert %s: %s", u, err)
+	}
 }
 
 func handleAssets(writer http.ResponseWriter, request *http.Request) {
@@ -270,119 +668,221 @@ func handleAssets(writer http.ResponseWriter, request *http.Request) {
 	http.FileServer(fs).ServeHTTP(writer, request)
 }
 
-func handleBookmarks(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
-	var data []byte
+func (d *Daemon) handleFeed(writer http.ResponseWriter, request *http.Request) {
+	feedURL := request.FormValue("url")
+	if feedURL == "" {
+		http.Error(writer, "Error: no feed URL specified", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(feedURL, "://") {
+		feedURL = "gemini://" + feedURL
+	}
 
-	postAddress := request.PostFormValue("address")
-	postLabel := request.PostFormValue("label")
-	if postLabel == "" && postAddress != "" {
-		postLabel = postAddress
+	requestURL, header, body, err := d.fetchResponse(d.requestProfile(request), feedURL)
+	if errors.Is(err, ErrAccessDenied) {
+		http.Error(writer, fmt.Sprintf("Error: failed to fetch %s: %s", feedURL, err), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(writer, fmt.Sprintf("Error: failed to fetch %s: %s", feedURL, err), http.StatusBadGateway)
+		return
 	}
+	defer body.Close()
 
-	editBookmark := request.FormValue("edit")
-	if editBookmark != "" {
-		if postLabel == "" {
-			label, ok := bookmarks[editBookmark]
-			if !ok {
-				writer.Write([]byte("<h1>Error: bookmark not found</h1>"))
-				return
-			}
+	mimeType, params := mediaType(header)
+	if !bytes.HasPrefix(header, []byte("20")) || mimeType != "text/gemini" {
+		http.Error(writer, fmt.Sprintf("Error: %s is not a Gemini page", feedURL), http.StatusBadGateway)
+		return
+	}
 
-			data = newPage()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error: failed to fetch %s: %s", feedURL, err), http.StatusBadGateway)
+		return
+	}
 
-			data = append(data, []byte(fmt.Sprintf(`<form method="post" action="%s"><h3>Edit bookmark</h3><input type="text" size="40" name="address" placeholder="Address" value="%s" autofocus><br><br><input type="text" size="40" name="label" placeholder="Label" value="%s"><br><br><input type="submit" value="Update"></form>`, request.URL.Path+"?"+request.URL.RawQuery, html.EscapeString(editBookmark), html.EscapeString(label)))...)
+	feed := ParseFeed(decodeCharset(data, params["charset"]), requestURL.String())
+	// Feeds and entries are identified by their Gemini URL, which does not
+	// change with the address of the daemon.
+	feed.Link = d.rewriteURL(feed.URL, requestURL)
+	for _, entry := range feed.Entries {
+		entry.Link = d.rewriteURL(entry.URL, requestURL)
+	}
 
-			data = append(data, []byte(pageFooter)...)
+	var out []byte
+	if request.FormValue("format") == "rss" {
+		writer.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		out, err = feed.RSS()
+	} else {
+		writer.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		out, err = feed.Atom()
+	}
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error: failed to generate feed: %s", err), http.StatusInternalServerError)
+		return
+	}
+	writer.Write(out)
+}
 
-			writer.Write(fillTemplateVariables(data, "", false))
-			return
-		}
+// Reconfigure updates the daemon options without interrupting active
+// connections. While the daemon is serving, the address and HTTPS options
+// are not changed.
+func (d *Daemon) Reconfigure(options *DaemonOptions) {
+	if options == nil {
+		options = &DaemonOptions{}
+	}
 
-		if editBookmark != postAddress || bookmarks[editBookmark] != postLabel {
-			RemoveBookmark(editBookmark)
-			AddBookmark(postAddress, postLabel)
-		}
-	} else if postLabel != "" {
-		AddBookmark(postAddress, postLabel)
+	d.serverLock.Lock()
+	serving := d.server != nil
+	d.serverLock.Unlock()
+
+	if serving {
+		newOptions := *options
+		current := d.getOptions()
+		newOptions.Address = current.Address
+		newOptions.CertFile = current.CertFile
+		newOptions.KeyFile = current.KeyFile
+		newOptions.SelfSigned = current.SelfSigned
+		options = &newOptions
 	}
+	d.configure(options)
+}
+
+// ServeHTTP serves a request.
+func (d *Daemon) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	d.startPolling()
 
-	deleteBookmark := request.FormValue("delete")
-	if deleteBookmark != "" {
-		RemoveBookmark(deleteBookmark)
+	if !d.allowedHost(request) {
+		http.Error(writer, "Error: invalid host", http.StatusMisdirectedRequest)
+		return
 	}
 
-	data = newPage()
+	setSecurityHeaders(writer.Header())
 
-	addBookmark := request.FormValue("add")
+	if prefix := d.basePath(); prefix != "" {
+		p := strings.TrimPrefix(request.URL.Path, prefix)
+		if len(p) == len(request.URL.Path) || (p != "" && p[0] != '/') {
+			http.NotFound(writer, request)
+			return
+		} else if p == "" {
+			http.Redirect(writer, request, prefix+"/", http.StatusMovedPermanently)
+			return
+		}
 
-	addressFocus := "autofocus"
-	labelFocus := ""
-	if addBookmark != "" {
-		addressFocus = ""
-		labelFocus = "autofocus"
+		stripped := new(http.Request)
+		*stripped = *request
+		stripped.URL = new(url.URL)
+		*stripped.URL = *request.URL
+		stripped.URL.Path = p
+		stripped.URL.RawPath = strings.TrimPrefix(request.URL.RawPath, prefix)
+		request = stripped
 	}
 
-	data = append(data, []byte(fmt.Sprintf(`<form method="post" action="/bookmarks"><h3>Add bookmark</h3><input type="text" size="40" name="address" placeholder="Address" value="%s" %s><br><br><input type="text" size="40" name="label" placeholder="Label" %s><br><br><input type="submit" value="Add"></form>`, html.EscapeString(addBookmark), addressFocus, labelFocus))...)
-
-	if len(bookmarks) > 0 && addBookmark == "" {
-		fakeURL, _ := url.Parse("/") // Always succeeds
+	// Only content received from Gemini servers is served from the content
+	// origin. Users may also sign in there, as cookies are not shared.
+	if d.isContentOrigin(request) && (request.URL.Path == "/" || !d.isContentPath(request.URL.Path)) && request.URL.Path != "/login" {
+		d.redirectToMain(writer, request)
+		return
+	}
 
-		data = append(data, []byte(`<br><h3>Bookmarks</h3><table border="1" cellpadding="5">`)...)
-		for _, u := range bookmarksSorted {
-			data = append(data, []byte(fmt.Sprintf(`<tr><td>%s<br><a href="%s">%s</a></td><td><a href="/bookmarks?edit=%s" class="navlink">Edit</a></td><td><a href="/bookmarks?delete=%s" onclick="return confirm('Are you sure you want to delete this bookmark?')" class="navlink">Delete</a></td></tr>`, html.EscapeString(bookmarks[u]), html.EscapeString(rewriteURL(u, fakeURL)), html.EscapeString(u), html.EscapeString(url.PathEscape(u)), html.EscapeString(url.PathEscape(u))))...)
-		}
-		data = append(data, []byte(`</table>`)...)
+	user, err := d.authenticate(request)
+	if err != nil && !publicPath(request.URL.Path) {
+		d.writeNotAuthenticated(writer, request)
+		return
+	} else if user != "" {
+		request = withUser(request, user)
 	}
 
-	data = append(data, []byte(pageFooter)...)
+	d.configLock.RLock()
+	handler := d.handler
+	d.configLock.RUnlock()
 
-	writer.Write(fillTemplateVariables(data, "", false))
+	handler.ServeHTTP(writer, request)
 }
 
-// SetOnBookmarksChanged sets the function called when a bookmark is changed.
-func SetOnBookmarksChanged(f func()) {
-	onBookmarksChanged = f
+// Serve accepts connections on the listener and serves requests. Serve
+// always returns a non-nil error. After Shutdown, http.ErrServerClosed is
+// returned.
+func (d *Daemon) Serve(listener net.Listener) error {
+	d.serverLock.Lock()
+	if d.server == nil {
+		d.server = &http.Server{Handler: d}
+	}
+	server := d.server
+	d.serverLock.Unlock()
+
+	d.startPolling()
+
+	return server.Serve(listener)
 }
 
-// StartDaemon starts the page conversion daemon.
-func StartDaemon(address string, hostname string, allowFile bool) error {
-	daemonAddress = address
-	if hostname != "" {
-		hostAddress = hostname
-	} else {
-		hostAddress = ""
+// ListenAndServe listens on the daemon address and serves requests.
+// ListenAndServe always returns a non-nil error. After Shutdown,
+// http.ErrServerClosed is returned.
+func (d *Daemon) ListenAndServe() error {
+	listener, err := d.listen()
+	if err != nil {
+		return err
 	}
-	allowFileAccess = allowFile
-
-	loadAssets()
+	return d.Serve(listener)
+}
 
-	// if len(bookmarks) == 0 {
-	// 	for u, label := range defaultBookmarks {
-	// 		AddBookmark(u, label)
-	// 	}
-	// }
+// Start listens on the daemon address and serves requests in the background.
+func (d *Daemon) Start() error {
+	address := d.getOptions().Address
+	listener, err := d.listen()
+	if err != nil {
+		return err
+	}
 
-	handler := http.NewServeMux()
-	handler.HandleFunc("/assets/style.css", handleAssets)
-	handler.HandleFunc("/bookmarks", handleBookmarks)
-	handler.HandleFunc("/", handleRequest)
 	go func() {
-		log.Fatal(http.ListenAndServe(address, handler))
+		err := d.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("failed to serve on %s: %s", address, err)
+		}
 	}()
-
 	return nil
 }
 
+// Shutdown gracefully stops the daemon. Subscriptions are no longer updated
+// and the server, when started via Start, Serve or ListenAndServe, stops
+// accepting new connections and waits for active requests to complete.
+// History pending to be saved is saved. The daemon may be started again
+// afterwards.
+func (d *Daemon) Shutdown(ctx context.Context) error {
+	d.pollLock.Lock()
+	if d.polling {
+		close(d.stopPolling)
+		d.polling = false
+		d.stopPolling = nil
+	}
+	d.pollLock.Unlock()
+
+	d.serverLock.Lock()
+	server := d.server
+	d.server = nil
+	d.serverLock.Unlock()
+
+	var err error
+	if server != nil {
+		err = server.Shutdown(ctx)
+	}
+
+	// Pages visited by the completed requests are saved as well.
+	for _, p := range d.allProfiles() {
+		p.history.flushPending()
+	}
+	return err
+}
+
 // LastRequestTime returns the time of the last request.
-func LastRequestTime() int64 {
-	return lastRequestTime
+func (d *Daemon) LastRequestTime() int64 {
+	return atomic.LoadInt64(&d.lastRequestTime)
 }
 
 // SetClientCertificate sets the client certificate to use for a domain.
-func SetClientCertificate(domain string, certificate []byte, privateKey []byte) error {
+func (p *Profile) SetClientCertificate(domain string, certificate []byte, privateKey []byte) error {
 	if len(certificate) == 0 || len(privateKey) == 0 {
-		delete(clientCerts, domain)
+		p.clientCerts.remove(domain)
 		return nil
 	}
 
@@ -396,50 +896,55 @@ func SetClientCertificate(domain string, certificate []byte, privateKey []byte)
 		clientCert.Leaf = leafCert
 	}
 
-	clientCerts[domain] = clientCert
+	p.clientCerts.set(domain, clientCert)
 	return nil
 }
 
-// AddBookmark adds a bookmark.
-func AddBookmark(u string, label string) {
-	parsed, err := url.Parse(u)
-	if err != nil {
-		return
-	}
-	if parsed.Scheme == "" {
-		parsed.Scheme = "gemini"
-	}
-	parsed.Host = strings.ToLower(parsed.Host)
-
-	bookmarks[parsed.String()] = label
+// GetClientCertificateDomains returns the domains client certificates are
+// set for.
+func (p *Profile) GetClientCertificateDomains() []string {
+	return p.clientCerts.domains()
+}
 
-	bookmarksUpdated()
+// SetClientCertificate sets the client certificate to use for a domain.
+func (d *Daemon) SetClientCertificate(domain string, certificate []byte, privateKey []byte) error {
+	return d.profile.SetClientCertificate(domain, certificate, privateKey)
 }
 
-// GetBookmarks returns all bookmarks.
-func GetBookmarks() map[string]string {
-	return bookmarks
+// GetClientCertificateDomains returns the domains client certificates are
+// set for.
+func (d *Daemon) GetClientCertificateDomains() []string {
+	return d.profile.GetClientCertificateDomains()
 }
 
-// RemoveBookmark removes a bookmark.
-func RemoveBookmark(u string) {
-	delete(bookmarks, u)
+// StartDaemon starts the page conversion daemon.
+func StartDaemon(address string, hostname string, allowFile bool) error {
+	return StartDaemonWithOptions(&DaemonOptions{
+		Address:   address,
+		Hostname:  hostname,
+		AllowFile: allowFile,
+	})
+}
 
-	bookmarksUpdated()
+// StartDaemonWithOptions starts the page conversion daemon.
+func StartDaemonWithOptions(options *DaemonOptions) error {
+	defaultDaemon.configure(options)
+	defaultDaemon.addDefaultBookmarks()
+	return defaultDaemon.Start()
 }
 
-func bookmarksUpdated() {
-	var allURLs []string
-	for u := range bookmarks {
-		allURLs = append(allURLs, u)
-	}
-	sort.Slice(allURLs, func(i, j int) bool {
-		return strings.ToLower(bookmarks[allURLs[i]]) < strings.ToLower(bookmarks[allURLs[j]])
-	})
+// LastRequestTime returns the time of the last request.
+func LastRequestTime() int64 {
+	return defaultDaemon.LastRequestTime()
+}
 
-	bookmarksSorted = allURLs
+// GetClientCertificateDomains returns the domains client certificates are
+// set for.
+func GetClientCertificateDomains() []string {
+	return defaultDaemon.GetClientCertificateDomains()
+}
 
-	if onBookmarksChanged != nil {
-		onBookmarksChanged()
-	}
+// SetClientCertificate sets the client certificate to use for a domain.
+func SetClientCertificate(domain string, certificate []byte, privateKey []byte) error {
+	return defaultDaemon.SetClientCertificate(domain, certificate, privateKey)
 }
@@ -0,0 +1,324 @@
+package gmitohtml
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// geminiHandler writes the response to a Gemini request.
+type geminiHandler func(w io.Writer, request string)
+
+// testGeminiServer starts a Gemini server serving requests with a handler
+// and returns its address. The server is stopped when the test ends.
+func testGeminiServer(t testing.TB, handler geminiHandler) string {
+	certPEM, keyPEM, err := generateSelfSignedCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				w := bufio.NewWriter(conn)
+				handler(w, strings.TrimSuffix(request, "\r\n"))
+				w.Flush()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// staticResponse returns a handler writing the same response to every
+// request.
+func staticResponse(response string) geminiHandler {
+	return func(w io.Writer, request string) {
+		io.WriteString(w, response)
+	}
+}
+
+// testDaemon returns a daemon requesting pages from a Gemini server.
+func testDaemon(address string, options *DaemonOptions) *Daemon {
+	if options == nil {
+		options = &DaemonOptions{}
+	}
+	options.Hostname = address
+	return NewDaemon(options)
+}
+
+// testSession starts a session with a daemon and returns its cookie and
+// request token.
+func testSession(t testing.TB, d *Daemon) (*http.Cookie, string) {
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie, d.requestToken(cookie.Value)
+		}
+	}
+	t.Fatal("no session cookie was set")
+	return nil, ""
+}
+
+// serve serves a request and returns the response.
+func serve(d *Daemon, method string, target string, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	request := httptest.NewRequest(method, "http://localhost"+target, body)
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, request)
+	return w
+}
+
+func TestFetchResponse(t *testing.T) {
+	address := testGeminiServer(t, func(w io.Writer, request string) {
+		switch request[strings.LastIndex(request, "/"):] {
+		case "/page":
+			io.WriteString(w, "20 text/gemini; charset=utf-8\r\n# Title\nText\n")
+		case "/large":
+			io.WriteString(w, "20 text/plain\r\n")
+			io.Copy(w, io.LimitReader(zeroReader{}, maxResponseSize))
+		case "/no-crlf":
+			io.WriteString(w, "20 text/gemini\n# Title\n")
+		case "/empty":
+		default:
+			io.WriteString(w, "51 Not found\r\n")
+		}
+	})
+	d := NewDaemon(nil)
+
+	_, header, body, err := d.fetchResponse(d.profile, "gemini://"+address+"/page")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if string(header) != "20 text/gemini; charset=utf-8" || string(data) != "# Title\nText\n" {
+		t.Errorf("unexpected response: header %q, body %q", header, data)
+	}
+
+	_, _, body, err = d.fetchResponse(d.profile, "gemini://"+address+"/large")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, err = io.Copy(ioutil.Discard, body)
+	body.Close()
+	if err != ErrResponseTooLarge {
+		t.Errorf("expected ErrResponseTooLarge, got %v", err)
+	}
+
+	for _, p := range []string{"/no-crlf", "/empty"} {
+		_, _, _, err = d.fetchResponse(d.profile, "gemini://"+address+p)
+		if err != ErrInvalidHeader {
+			t.Errorf("%s: expected ErrInvalidHeader, got %v", p, err)
+		}
+	}
+}
+
+// zeroReader reads zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestHandleRequestStreamsPage(t *testing.T) {
+	page := "# Streamed\n" + strings.Repeat("Line of text\n", 100000)
+	address := testGeminiServer(t, staticResponse("20 text/gemini\r\n"+page))
+	d := testDaemon(address, &DaemonOptions{History: true})
+	d.EnableHistory("", 0)
+
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/page.gmi", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if n := bytes.Count(w.Body.Bytes(), []byte("<p>Line of text</p>")); n != 100000 {
+		t.Errorf("expected 100000 lines, got %d", n)
+	}
+
+	entries := d.GetHistory()
+	if len(entries) != 1 || entries[0].Title != "Streamed" {
+		t.Errorf("expected page to be recorded in history with its title, got %+v", entries)
+	}
+}
+
+func TestHandleRequestInputPrompt(t *testing.T) {
+	address := testGeminiServer(t, staticResponse("10 Enter your name\r\n"))
+	d := testDaemon(address, nil)
+
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/input", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Enter your name") {
+		t.Errorf("expected input prompt, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	address := testGeminiServer(t, staticResponse("20 text/gemini\r\n# Log\n=> entry.gmi 2021-01-02 Entry\n"))
+	d := testDaemon(address, &DaemonOptions{Bookmarks: true, Subscriptions: true, History: true})
+	defer d.Shutdown(context.Background())
+	d.EnableHistory("", 0)
+	cookie, token := testSession(t, d)
+	defaultBookmarks := len(d.GetBookmarkEntries())
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(5)
+		go func() {
+			defer wg.Done()
+			w := serve(d, "POST", "/bookmarks", cookie, url.Values{
+				"csrf":    {token},
+				"address": {fmt.Sprintf("gemini://%s/bookmark%d.gmi", address, i)},
+				"label":   {fmt.Sprintf("Bookmark %d", i)},
+				"folder":  {"Folder"},
+			})
+			if w.Code != http.StatusSeeOther {
+				t.Errorf("failed to add bookmark: %d %s", w.Code, w.Body.String())
+			}
+			serve(d, "GET", "/bookmarks", cookie, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			w := serve(d, "POST", "/subscriptions", cookie, url.Values{
+				"csrf":    {token},
+				"address": {fmt.Sprintf("gemini://%s/log%d/", address, i)},
+			})
+			if w.Code != http.StatusSeeOther {
+				t.Errorf("failed to add subscription: %d %s", w.Code, w.Body.String())
+			}
+			serve(d, "GET", "/subscriptions", cookie, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			w := serve(d, "GET", fmt.Sprintf("/page%d.gmi", i), cookie, nil)
+			if w.Code != http.StatusOK {
+				t.Errorf("failed to fetch page: %d %s", w.Code, w.Body.String())
+			}
+			serve(d, "GET", "/history", cookie, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			_, _, body, err := d.fetchResponse(d.profile, fmt.Sprintf("gemini://%s/fetch%d.gmi", address, i))
+			if err != nil {
+				t.Errorf("failed to fetch page: %s", err)
+				return
+			}
+			io.Copy(ioutil.Discard, body)
+			body.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			d.GetSubscriptions()
+			d.GetBookmarkEntries()
+			d.GetHistory()
+		}()
+	}
+	wg.Wait()
+
+	if l := len(d.GetBookmarkEntries()); l != defaultBookmarks+n {
+		t.Errorf("expected %d bookmarks, got %d", defaultBookmarks+n, l)
+	}
+	if l := len(d.GetSubscriptions()); l != n {
+		t.Errorf("expected %d subscriptions, got %d", n, l)
+	}
+	if l := len(d.GetHistory()); l != n {
+		t.Errorf("expected %d history entries, got %d", n, l)
+	}
+}
+
+func TestConcurrentClientCertificates(t *testing.T) {
+	address := testGeminiServer(t, staticResponse("20 text/gemini\r\n# Page\n"))
+	d := testDaemon(address, nil)
+	host := strings.Split(address, ":")[0]
+
+	certPEM, keyPEM, err := generateSelfSignedCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.SetClientCertificate(host, []byte("invalid"), []byte("invalid"))
+	if err == nil {
+		t.Error("expected error setting invalid certificate")
+	}
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			domain := host
+			if i%2 == 1 {
+				domain = fmt.Sprintf("example%d.org", i)
+			}
+			err := d.SetClientCertificate(domain, certPEM, keyPEM)
+			if err != nil {
+				t.Errorf("failed to set certificate: %s", err)
+			}
+			if i%4 == 3 {
+				d.SetClientCertificate(domain, nil, nil)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			d.GetClientCertificateDomains()
+		}()
+		go func() {
+			defer wg.Done()
+			w := serve(d, "GET", fmt.Sprintf("/page%d.gmi", i), nil, nil)
+			if w.Code != http.StatusOK {
+				t.Errorf("failed to fetch page: %d %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	domains := d.GetClientCertificateDomains()
+	if len(domains) != 1+n/4 {
+		t.Errorf("expected %d domains with certificates, got %v", 1+n/4, domains)
+	}
+}
@@ -0,0 +1,355 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const feedDateLayout = "2006-01-02"
+
+// ErrInvalidFeed is the error returned when a feed can not be parsed.
+var ErrInvalidFeed = errors.New("invalid feed")
+
+// ErrNoFeedURL is the error returned when generating a feed without a URL.
+var ErrNoFeedURL = errors.New("feed URL not specified")
+
+// FeedEntry is an entry of a Gemini feed. URL identifies the entry, and Link
+// is the URL the entry is linked to. When Link is empty, URL is linked to.
+type FeedEntry struct {
+	URL     string
+	Link    string `json:",omitempty"`
+	Title   string
+	Updated time.Time
+}
+
+// Feed is a Gemini feed, as defined by the "Subscribing to Gemini pages"
+// companion specification. URL identifies the feed, and Link is the URL the
+// feed is linked to. When Link is empty, URL is linked to. Author is the
+// name of the author of the feed. When Author is empty, generated Atom feeds
+// name the hostname of URL, or the title, as author.
+type Feed struct {
+	URL      string
+	Link     string `json:",omitempty"`
+	Author   string `json:",omitempty"`
+	Title    string
+	Subtitle string
+	Updated  time.Time
+	Entries  []*FeedEntry
+}
+
+// link returns the URL the feed is linked to.
+func (f *Feed) link() string {
+	if f.Link != "" {
+		return f.Link
+	}
+	return f.URL
+}
+
+// author returns the name of the author of the feed.
+func (f *Feed) author() string {
+	if f.Author != "" {
+		return f.Author
+	}
+	u, err := url.Parse(f.URL)
+	if err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return f.Title
+}
+
+// link returns the URL the entry is linked to.
+func (e *FeedEntry) link() string {
+	if e.Link != "" {
+		return e.Link
+	}
+	return e.URL
+}
+
+// ParseFeed parses a gemlog index page. The first level one heading is used
+// as the feed title, and every link whose label starts with a date in
+// YYYY-MM-DD format is an entry. Relative links are resolved against u.
+func ParseFeed(page []byte, u string) *Feed {
+	feed := &Feed{URL: u}
+
+	baseURL, err := url.Parse(u)
+	if err != nil {
+		baseURL = nil
+	}
+
+	var preformatted bool
+	var lastHeading bool
+
+	scanner := newLineScanner(bytes.NewReader(page))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "```") {
+			preformatted = !preformatted
+			continue
+		} else if preformatted {
+			continue
+		}
+
+		if feed.Title == "" && strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "##") {
+			feed.Title = strings.TrimSpace(line[1:])
+			lastHeading = true
+			continue
+		} else if lastHeading && feed.Subtitle == "" && strings.HasPrefix(line, "##") && !strings.HasPrefix(line, "###") {
+			feed.Subtitle = strings.TrimSpace(line[2:])
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			lastHeading = false
+		}
+
+		linkURL, linkLabel := splitLink(line)
+		if linkURL == "" || len(linkLabel) < len(feedDateLayout) {
+			continue
+		}
+
+		updated, err := time.Parse(feedDateLayout, linkLabel[:len(feedDateLayout)])
+		if err != nil {
+			continue
+		}
+
+		title := strings.TrimSpace(linkLabel[len(feedDateLayout):])
+		title = strings.TrimSpace(strings.TrimLeft(title, "-–—:"))
+		if title == "" {
+			title = linkLabel
+		}
+
+		if baseURL != nil {
+			parsed, err := baseURL.Parse(linkURL)
+			if err == nil {
+				linkURL = parsed.String()
+			}
+		}
+
+		feed.Entries = append(feed.Entries, &FeedEntry{
+			URL:     linkURL,
+			Title:   title,
+			Updated: updated,
+		})
+	}
+
+	sort.SliceStable(feed.Entries, func(i, j int) bool {
+		return feed.Entries[i].Updated.After(feed.Entries[j].Updated)
+	})
+	if len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	}
+	if feed.Title == "" {
+		feed.Title = u
+	}
+	return feed
+}
+
+// splitLink returns the URL and label of a link line. An empty URL is
+// returned when the line is not a link.
+func splitLink(line string) (string, string) {
+	if !strings.HasPrefix(line, "=>") {
+		return "", ""
+	}
+
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return "", ""
+	} else if len(fields) == 1 {
+		return fields[0], fields[0]
+	}
+
+	label := strings.TrimSpace(line[2:])
+	label = strings.TrimSpace(label[len(fields[0]):])
+	return fields[0], label
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string       `xml:"title"`
+	Subtitle string       `xml:"subtitle,omitempty"`
+	Author   atomAuthor   `xml:"author"`
+	ID       string       `xml:"id"`
+	Link     []atomLink   `xml:"link"`
+	Updated  string       `xml:"updated"`
+	Entries  []*atomEntry `xml:"entry"`
+}
+
+// Atom returns the feed in Atom format. Feeds without a URL may not be
+// generated in Atom format, as the URL identifies the feed. The author is
+// specified at feed level, as Atom requires an author for every entry.
+func (f *Feed) Atom() ([]byte, error) {
+	if f.URL == "" {
+		return nil, ErrNoFeedURL
+	}
+
+	feed := &atomFeed{
+		Title:    f.Title,
+		Subtitle: f.Subtitle,
+		Author:   atomAuthor{Name: f.author()},
+		ID:       f.URL,
+		Link:     []atomLink{{Href: f.link(), Rel: "alternate"}},
+		Updated:  f.Updated.UTC().Format(time.RFC3339),
+	}
+	for _, entry := range f.Entries {
+		feed.Entries = append(feed.Entries, &atomEntry{
+			Title:   entry.Title,
+			ID:      entry.URL,
+			Link:    atomLink{Href: entry.link(), Rel: "alternate"},
+			Updated: entry.Updated.UTC().Format(time.RFC3339),
+		})
+	}
+	return marshalFeed(feed)
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type rssItem struct {
+	Title   string   `xml:"title"`
+	Link    string   `xml:"link"`
+	GUID    *rssGUID `xml:"guid"`
+	PubDate string   `xml:"pubDate"`
+}
+
+type rssChannel struct {
+	Title       string     `xml:"title"`
+	Link        string     `xml:"link"`
+	Description string     `xml:"description"`
+	Items       []*rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name    `xml:"rss"`
+	Version string      `xml:"version,attr"`
+	Channel *rssChannel `xml:"channel"`
+}
+
+// RSS returns the feed in RSS 2.0 format.
+func (f *Feed) RSS() ([]byte, error) {
+	channel := &rssChannel{
+		Title:       f.Title,
+		Link:        f.link(),
+		Description: f.Subtitle,
+	}
+	for _, entry := range f.Entries {
+		channel.Items = append(channel.Items, &rssItem{
+			Title:   entry.Title,
+			Link:    entry.link(),
+			GUID:    &rssGUID{Value: entry.URL, IsPermaLink: entry.link() == entry.URL},
+			PubDate: entry.Updated.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return marshalFeed(&rssFeed{Version: "2.0", Channel: channel})
+}
+
+func marshalFeed(v interface{}) ([]byte, error) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
+
+type atomInputEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Links     []atomLink `xml:"link"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+}
+
+type atomInputFeed struct {
+	XMLName  xml.Name          `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string            `xml:"title"`
+	Subtitle string            `xml:"subtitle"`
+	Authors  []atomAuthor      `xml:"author"`
+	Updated  string            `xml:"updated"`
+	Entries  []*atomInputEntry `xml:"entry"`
+}
+
+// ParseAtom parses an Atom feed. Relative links are resolved against u.
+func ParseAtom(data []byte, u string) (*Feed, error) {
+	var parsed atomInputFeed
+	err := xml.Unmarshal(data, &parsed)
+	if err != nil {
+		return nil, ErrInvalidFeed
+	}
+
+	baseURL, err := url.Parse(u)
+	if err != nil {
+		baseURL = nil
+	}
+
+	feed := &Feed{
+		URL:      u,
+		Title:    strings.TrimSpace(parsed.Title),
+		Subtitle: strings.TrimSpace(parsed.Subtitle),
+	}
+	if len(parsed.Authors) > 0 {
+		feed.Author = strings.TrimSpace(parsed.Authors[0].Name)
+	}
+	feed.Updated, _ = time.Parse(time.RFC3339, parsed.Updated)
+
+	for _, entry := range parsed.Entries {
+		var linkURL string
+		for _, link := range entry.Links {
+			if link.Rel == "" || link.Rel == "alternate" {
+				linkURL = link.Href
+				break
+			}
+		}
+		if linkURL == "" {
+			linkURL = entry.ID
+		}
+		if baseURL != nil {
+			resolved, err := baseURL.Parse(linkURL)
+			if err == nil {
+				linkURL = resolved.String()
+			}
+		}
+
+		updated, err := time.Parse(time.RFC3339, entry.Updated)
+		if err != nil {
+			updated, _ = time.Parse(time.RFC3339, entry.Published)
+		}
+
+		feed.Entries = append(feed.Entries, &FeedEntry{
+			URL:     linkURL,
+			Title:   strings.TrimSpace(entry.Title),
+			Updated: updated,
+		})
+	}
+
+	sort.SliceStable(feed.Entries, func(i, j int) bool {
+		return feed.Entries[i].Updated.After(feed.Entries[j].Updated)
+	})
+	if feed.Updated.IsZero() && len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	}
+	if feed.Title == "" {
+		feed.Title = u
+	}
+	return feed, nil
+}
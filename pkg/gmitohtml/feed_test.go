@@ -0,0 +1,177 @@
+package gmitohtml
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFeedURL = "gemini://example.org/gemlog/"
+
+// testGemlog parses the gemlog index page in testdata.
+func testGemlog(t testing.TB) *Feed {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "gemlog.gmi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ParseFeed(data, testFeedURL)
+}
+
+func testDate(value string) time.Time {
+	date, err := time.Parse(feedDateLayout, value)
+	if err != nil {
+		panic(err)
+	}
+	return date
+}
+
+// testGemlogEntries are the entries of the gemlog index page in testdata.
+var testGemlogEntries = []*FeedEntry{
+	{URL: "gemini://example.org/gemlog/2021-04-01.gmi", Title: "2021-04-01", Updated: testDate("2021-04-01")},
+	{URL: "gemini://example.org/gemlog/2021-03-01-spring.gmi", Title: "Spring is here", Updated: testDate("2021-03-01")},
+	{URL: "gemini://example.org/gemlog/2021-02-10-tea.gmi", Title: "Tea & <biscuits>", Updated: testDate("2021-02-10")},
+	{URL: "gemini://example.org/gemlog/2021-01-15.gmi", Title: "Winter walks", Updated: testDate("2021-01-15")},
+	{URL: "https://example.com/2019-12-24.html", Title: "Elsewhere", Updated: testDate("2019-12-24")},
+}
+
+func TestParseFeed(t *testing.T) {
+	feed := testGemlog(t)
+	if feed.URL != testFeedURL || feed.Title != "Example gemlog" || feed.Subtitle != "Thoughts on Gemini" {
+		t.Errorf("unexpected feed: %+v", feed)
+	} else if !feed.Updated.Equal(testDate("2021-04-01")) {
+		t.Errorf("expected feed to be updated on 2021-04-01, got %s", feed.Updated)
+	}
+	if !reflect.DeepEqual(feed.Entries, testGemlogEntries) {
+		for _, entry := range feed.Entries {
+			t.Logf("%+v", entry)
+		}
+		t.Error("unexpected entries")
+	}
+
+	feed = ParseFeed([]byte("=> a.gmi 2021-01-01 Entry\n"), testFeedURL)
+	if feed.Title != testFeedURL || len(feed.Entries) != 1 {
+		t.Errorf("expected untitled feed to be titled by its URL, got %+v", feed)
+	}
+}
+
+func TestParseAtom(t *testing.T) {
+	data := `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title> Example feed </title>
+  <subtitle>Subtitle</subtitle>
+  <author><name>Alice</name></author>
+  <updated>2021-05-01T12:00:00Z</updated>
+  <entry>
+    <title>Relative</title>
+    <id>urn:uuid:1</id>
+    <link rel="self" href="/self.xml"/>
+    <link href="entry1.gmi"/>
+    <updated>2021-01-01T00:00:00Z</updated>
+  </entry>
+  <entry>
+    <title>Published</title>
+    <id>gemini://example.org/entry2.gmi</id>
+    <published>2021-03-01T00:00:00+01:00</published>
+  </entry>
+</feed>`
+
+	feed, err := ParseAtom([]byte(data), testFeedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Title != "Example feed" || feed.Subtitle != "Subtitle" || feed.Author != "Alice" {
+		t.Errorf("unexpected feed: %+v", feed)
+	} else if !feed.Updated.Equal(time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected update time: %s", feed.Updated)
+	}
+	expected := []*FeedEntry{
+		{URL: "gemini://example.org/entry2.gmi", Title: "Published", Updated: time.Date(2021, 2, 28, 23, 0, 0, 0, time.UTC)},
+		{URL: "gemini://example.org/gemlog/entry1.gmi", Title: "Relative", Updated: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	if len(feed.Entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(feed.Entries))
+	}
+	for i, entry := range feed.Entries {
+		if entry.URL != expected[i].URL || entry.Title != expected[i].Title || !entry.Updated.Equal(expected[i].Updated) {
+			t.Errorf("expected entry %+v, got %+v", expected[i], entry)
+		}
+	}
+
+	if _, err := ParseAtom([]byte("<rss></rss>"), testFeedURL); err != ErrInvalidFeed {
+		t.Errorf("expected ErrInvalidFeed, got %v", err)
+	}
+}
+
+func TestFeedAtom(t *testing.T) {
+	feed := testGemlog(t)
+	out, err := feed.Atom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "<author>\n    <name>example.org</name>\n  </author>") {
+		t.Errorf("expected feed level author, got:\n%s", out)
+	} else if !strings.Contains(string(out), "Tea &amp; &lt;biscuits&gt;") {
+		t.Errorf("expected titles to be escaped, got:\n%s", out)
+	}
+
+	parsed, err := ParseAtom(out, testFeedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Title != feed.Title || parsed.Subtitle != feed.Subtitle || parsed.Author != "example.org" || !parsed.Updated.Equal(feed.Updated) {
+		t.Errorf("unexpected feed: %+v", parsed)
+	}
+	if !reflect.DeepEqual(parsed.Entries, testGemlogEntries) {
+		for _, entry := range parsed.Entries {
+			t.Logf("%+v", entry)
+		}
+		t.Error("unexpected entries")
+	}
+
+	feed.Author = "Alice"
+	out, _ = feed.Atom()
+	if !strings.Contains(string(out), "<name>Alice</name>") {
+		t.Errorf("expected author Alice, got:\n%s", out)
+	}
+
+	if _, err := (&Feed{Title: "No URL"}).Atom(); err != ErrNoFeedURL {
+		t.Errorf("expected ErrNoFeedURL, got %v", err)
+	}
+}
+
+func TestFeedRSS(t *testing.T) {
+	feed := testGemlog(t)
+	feed.Entries[0].Link = "https://example.org/gemlog/2021-04-01.html"
+	out, err := feed.RSS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed rssFeed
+	err = xml.Unmarshal(out, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := parsed.Channel
+	if parsed.Version != "2.0" || channel.Title != "Example gemlog" || channel.Link != testFeedURL || channel.Description != "Thoughts on Gemini" {
+		t.Errorf("unexpected channel: %+v", channel)
+	}
+	if len(channel.Items) != len(testGemlogEntries) {
+		t.Fatalf("expected %d items, got %d", len(testGemlogEntries), len(channel.Items))
+	}
+	for i, item := range channel.Items {
+		entry := feed.Entries[i]
+		if item.Title != entry.Title || item.Link != entry.link() || item.GUID.Value != entry.URL {
+			t.Errorf("unexpected item: %+v", item)
+		} else if item.GUID.IsPermaLink != (i != 0) {
+			t.Errorf("%s: expected isPermaLink %v", item.Title, i != 0)
+		}
+		if item.PubDate != entry.Updated.Format(time.RFC1123Z) {
+			t.Errorf("%s: unexpected publication date %s", item.Title, item.PubDate)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrFileAccessDenied is the error returned when a file outside of the file
+// roots is requested.
+var ErrFileAccessDenied = errors.New("file access denied")
+
+// geminiExtensions are the file extensions of text/gemini files.
+var geminiExtensions = []string{".gmi", ".gemini"}
+
+// fileRoots returns the directories local files may be served from, both as
+// specified and with symbolic links resolved.
+func (o *DaemonOptions) fileRoots() []string {
+	roots := o.FileRoots
+	if len(roots) == 0 {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil
+		}
+		roots = []string{wd}
+	}
+
+	var resolved []string
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		resolved = append(resolved, root)
+
+		root, err = filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		resolved = append(resolved, root)
+	}
+	return resolved
+}
+
+// openFile opens a file located within one of the roots. The file is opened
+// before symbolic links are resolved and checked, and the opened file must be
+// the file the resolved path refers to. This way, replacing part of the path
+// with a symbolic link after it was checked can not escape the roots. An
+// error is returned when the file is not located within one of the roots.
+func openFile(roots []string, file string) (*os.File, os.FileInfo, error) {
+	file = filepath.Clean(file)
+	if !withinRoots(roots, file) {
+		return nil, nil, ErrFileAccessDenied
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	} else if !withinRoots(roots, resolved) {
+		f.Close()
+		return nil, nil, ErrFileAccessDenied
+	}
+	resolvedInfo, err := os.Stat(resolved)
+	if err != nil || !os.SameFile(info, resolvedInfo) {
+		f.Close()
+		return nil, nil, ErrFileAccessDenied
+	}
+	return f, info, nil
+}
+
+// withinRoots returns whether a path is located within one of the roots.
+func withinRoots(roots []string, file string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, file)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalClient returns whether a request was sent from the local machine,
+// via a loopback address or a Unix domain socket. Requests forwarded by a
+// reverse proxy on the local machine are only local when the address of the
+// client, as provided in the Forwarded, X-Forwarded-For or X-Real-IP header,
+// is a loopback address.
+func isLocalClient(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err == nil {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+
+	client, forwarded := forwardedClient(request.Header)
+	if !forwarded {
+		return true
+	}
+	ip := net.ParseIP(client)
+	return ip != nil && ip.IsLoopback()
+}
+
+// forwardedClient returns the address of the client a request was forwarded
+// for by the closest reverse proxy, and whether the request was forwarded.
+func forwardedClient(header http.Header) (string, bool) {
+	var client string
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		elements := strings.Split(values[len(values)-1], ",")
+		for _, pair := range strings.Split(elements[len(elements)-1], ";") {
+			split := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(split) == 2 && strings.EqualFold(split[0], "for") {
+				client = strings.Trim(split[1], `"`)
+			}
+		}
+	} else if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+		addresses := strings.Split(values[len(values)-1], ",")
+		client = addresses[len(addresses)-1]
+	} else if values := header.Values("X-Real-IP"); len(values) > 0 {
+		client = values[len(values)-1]
+	} else {
+		return "", false
+	}
+
+	client = strings.TrimSpace(client)
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	return strings.Trim(client, "[]"), true
+}
+
+// fileType returns the MIME type of a file.
+func fileType(file string) string {
+	ext := strings.ToLower(path.Ext(file))
+	for _, geminiExt := range geminiExtensions {
+		if ext == geminiExt {
+			return "text/gemini; charset=utf-8"
+		}
+	}
+
+	mimeType := mime.TypeByExtension(ext)
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return mimeType
+}
+
+// directoryIndex returns a text/gemini index of an opened directory.
+func directoryIndex(dir *os.File, displayPath string) ([]byte, error) {
+	files, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].IsDir() != files[j].IsDir() {
+			return files[i].IsDir()
+		}
+		return strings.ToLower(files[i].Name()) < strings.ToLower(files[j].Name())
+	})
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Index of %s\n\n", displayPath)
+	if displayPath != "/" {
+		b.WriteString("=> ../ ..\n")
+	}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(&b, "=> %s %s\n", (&url.URL{Path: "./" + name}).String(), name)
+	}
+	return b.Bytes(), nil
+}
+
+func (d *Daemon) handleFile(writer http.ResponseWriter, request *http.Request) {
+	options := d.getOptions()
+	if !options.AllowFile {
+		http.Error(writer, "Error: file access is not allowed", http.StatusForbidden)
+		return
+	} else if !options.AllowRemoteFile && !isLocalClient(request) {
+		http.Error(writer, "Error: file access is only allowed from the local machine", http.StatusForbidden)
+		return
+	}
+
+	filePath := path.Clean("/" + strings.TrimPrefix(request.URL.Path, "/file"))
+	u := (&url.URL{Scheme: "file", Path: filePath}).String()
+
+	f, info, err := openFile(options.fileRoots(), filepath.FromSlash(filePath))
+	if err != nil {
+		status := http.StatusNotFound
+		if err == ErrFileAccessDenied {
+			status = http.StatusForbidden
+		}
+		http.Error(writer, fmt.Sprintf("Error: failed to read file %s: %s", filePath, err), status)
+		return
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	mimeType := "text/gemini"
+	if info.IsDir() {
+		if !strings.HasSuffix(request.URL.Path, "/") {
+			http.Redirect(writer, request, d.pagePath(request.URL.Path+"/"), http.StatusMovedPermanently)
+			return
+		}
+		if filePath != "/" {
+			u += "/"
+		}
+
+		data, err := directoryIndex(f, filePath)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Error: failed to read file %s: %s", filePath, err), http.StatusInternalServerError)
+			return
+		}
+		r = bytes.NewReader(data)
+	} else {
+		mimeType = fileType(filePath)
+	}
+
+	p := d.requestProfile(request)
+	if !info.IsDir() {
+		d.recordMediaType(p, u, strings.SplitN(mimeType, ";", 2)[0])
+	}
+	if !strings.HasPrefix(mimeType, "text/gemini") {
+		// Files are streamed, supporting range and conditional requests.
+		if d.contentHeader(writer, request, mimeType) {
+			http.ServeContent(writer, request, info.Name(), info.ModTime(), f)
+		}
+		return
+	} else if d.isContentOrigin(request) {
+		d.redirectToMain(writer, request)
+		return
+	}
+
+	convertOptions := options.convertOptions(u)
+	d.mediaOptions(convertOptions, p)
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	meta, err := d.convert(writer, r, p, d.requestToken(d.session(writer, request)), convertOptions)
+	if meta != nil && !info.IsDir() {
+		p.history.add(u, meta.Title)
+	}
+	if err != nil {
+		log.Printf("failed to convert %s: %s", u, err)
+	}
+}
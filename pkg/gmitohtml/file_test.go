@@ -0,0 +1,148 @@
+package gmitohtml
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFileRoot creates a file root containing page.gmi, text.txt, a
+// directory and symbolic links, next to a directory containing secret.txt.
+// It returns the root and the other directory.
+func testFileRoot(t testing.TB) (string, string) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+
+	files := map[string]string{
+		filepath.Join(root, "page.gmi"):       "# Page\n",
+		filepath.Join(root, "text.txt"):       "0123456789",
+		filepath.Join(root, "dir", "sub.gmi"): "# Sub\n",
+		filepath.Join(outside, "secret.txt"):  "top secret",
+	}
+	for file, data := range files {
+		os.MkdirAll(filepath.Dir(file), 0755)
+		err := ioutil.WriteFile(file, []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "inside.gmi"): filepath.Join(root, "page.gmi"),
+		filepath.Join(root, "escape.txt"): filepath.Join(outside, "secret.txt"),
+		filepath.Join(root, "escape"):     outside,
+	}
+	for link, target := range links {
+		err := os.Symlink(target, link)
+		if err != nil {
+			t.Skipf("symbolic links are not supported: %s", err)
+		}
+	}
+	return root, outside
+}
+
+func TestOpenFile(t *testing.T) {
+	root, outside := testFileRoot(t)
+	roots := []string{root}
+
+	tests := []struct {
+		file   string
+		denied bool
+	}{
+		{filepath.Join(root, "page.gmi"), false},
+		{filepath.Join(root, "dir"), false},
+		{filepath.Join(root, "inside.gmi"), false},
+		{root, false},
+		{filepath.Join(root, "..", "outside", "secret.txt"), true},
+		{filepath.Join(root, "dir", "..", "..", "outside", "secret.txt"), true},
+		{filepath.Join(outside, "secret.txt"), true},
+		{filepath.Join(root, "escape.txt"), true},
+		{filepath.Join(root, "escape", "secret.txt"), true},
+	}
+	for _, test := range tests {
+		f, _, err := openFile(roots, test.file)
+		if err == nil {
+			f.Close()
+		}
+		if test.denied && err != ErrFileAccessDenied {
+			t.Errorf("expected %s to be denied, got %v", test.file, err)
+		} else if !test.denied && err != nil {
+			t.Errorf("expected %s to be opened, got %s", test.file, err)
+		}
+	}
+}
+
+func TestHandleFile(t *testing.T) {
+	root, outside := testFileRoot(t)
+	d := NewDaemon(&DaemonOptions{AllowFile: true, FileRoots: []string{root}})
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		header     http.Header
+		status     int
+	}{
+		{"page", root + "/page.gmi", "127.0.0.1:1234", nil, http.StatusOK},
+		{"directory", root + "/dir/", "127.0.0.1:1234", nil, http.StatusOK},
+		{"text", root + "/text.txt", "127.0.0.1:1234", nil, http.StatusOK},
+		{"unix socket", root + "/page.gmi", "@", nil, http.StatusOK},
+		{"traversal", root + "/../outside/secret.txt", "127.0.0.1:1234", nil, http.StatusMovedPermanently},
+		{"outside", outside + "/secret.txt", "127.0.0.1:1234", nil, http.StatusForbidden},
+		{"symbolic link escape", root + "/escape.txt", "127.0.0.1:1234", nil, http.StatusForbidden},
+		{"symbolic link directory escape", root + "/escape/secret.txt", "127.0.0.1:1234", nil, http.StatusForbidden},
+		{"remote client", root + "/page.gmi", "192.0.2.1:1234", nil, http.StatusForbidden},
+		{"forwarded local client", root + "/page.gmi", "127.0.0.1:1234", http.Header{"X-Forwarded-For": {"127.0.0.1"}}, http.StatusOK},
+		{"forwarded remote client", root + "/page.gmi", "127.0.0.1:1234", http.Header{"X-Forwarded-For": {"192.0.2.1"}}, http.StatusForbidden},
+		{"forwarded remote client via proxies", root + "/page.gmi", "127.0.0.1:1234", http.Header{"X-Forwarded-For": {"127.0.0.1, 192.0.2.1"}}, http.StatusForbidden},
+		{"forwarded header", root + "/page.gmi", "127.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:1234"`}}, http.StatusForbidden},
+		{"real IP", root + "/page.gmi", "127.0.0.1:1234", http.Header{"X-Real-Ip": {"192.0.2.1"}}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "http://localhost/file"+test.path, nil)
+		request.RemoteAddr = test.remoteAddr
+		for name, values := range test.header {
+			request.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, request)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body.String())
+		} else if strings.Contains(w.Body.String(), "top secret") {
+			t.Errorf("%s: file outside of root was served", test.name)
+		}
+	}
+
+	// Paths are cleaned before they are handled, and by the handler itself.
+	request := httptest.NewRequest("GET", "http://localhost/file"+root+"/../outside/secret.txt", nil)
+	request.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	d.handleFile(w, request)
+	if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "top secret") {
+		t.Errorf("traversal: expected status %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+}
+
+func TestHandleFileRange(t *testing.T) {
+	root, _ := testFileRoot(t)
+	d := NewDaemon(&DaemonOptions{AllowFile: true, FileRoots: []string{root}})
+
+	request := httptest.NewRequest("GET", "http://localhost/file"+root+"/text.txt", nil)
+	request.RemoteAddr = "127.0.0.1:1234"
+	request.Header.Set("Range", "bytes=2-4")
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, request)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Errorf("expected partial content, got %d: %q", w.Code, w.Body.String())
+	} else if w.Header().Get("Content-Security-Policy") != sandboxPolicy {
+		t.Errorf("expected sandbox policy, got %q", w.Header().Get("Content-Security-Policy"))
+	}
+}
@@ -0,0 +1,254 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// convertedTags are the elements generated when converting a document.
+var convertedTags = []string{
+	"a", "article", "audio", "code", "details", "figcaption", "figure",
+	"h1", "h2", "h3", "h4", "h5", "h6", "img", "li", "nav", "p", "pre", "span",
+	"summary", "ul", "video",
+}
+
+// pageTags are the elements generated by page templates, in addition to
+// the elements of converted documents.
+var pageTags = []string{
+	"!DOCTYPE", "b", "body", "br", "button", "div", "form", "head", "html",
+	"input", "link", "main", "meta", "option", "select", "style", "table",
+	"td", "title", "tr",
+}
+
+// allowedAttributes are the attributes of generated elements.
+var allowedAttributes = []string{
+	"action", "alt", "aria-label", "autocapitalize", "autocomplete",
+	"autocorrect", "autofocus", "border", "cellpadding", "charset", "class",
+	"content", "controls", "dir", "enctype", "href", "html", "id", "lang",
+	"loading", "method", "name", "novalidate", "placeholder", "preload",
+	"property", "rel", "role", "size", "spellcheck", "src", "type", "value",
+}
+
+// checkMarkup verifies that a page only contains the specified elements and
+// allowed attributes, and that links do not run scripts. Text provided to
+// the converter must be escaped, so any other element or attribute was
+// injected.
+func checkMarkup(page []byte, tags ...[]string) error {
+	if !utf8.Valid(page) {
+		return fmt.Errorf("output is not valid UTF-8")
+	}
+
+	allowedTags := make(map[string]bool)
+	for _, list := range tags {
+		for _, tag := range list {
+			allowedTags[tag] = true
+		}
+	}
+	attributes := make(map[string]bool)
+	for _, attribute := range allowedAttributes {
+		attributes[attribute] = true
+	}
+
+	s := string(page)
+	for {
+		i := strings.IndexByte(s, '<')
+		if i == -1 {
+			return nil
+		}
+		s = s[i+1:]
+
+		// The contents of style elements are generated.
+		if strings.HasPrefix(s, "style>") {
+			end := strings.Index(s, "</style>")
+			if end == -1 {
+				return fmt.Errorf("unterminated style element")
+			}
+			s = s[end+len("</style>"):]
+			continue
+		}
+
+		s = strings.TrimPrefix(s, "/")
+		end := strings.IndexAny(s, " >")
+		if end == -1 {
+			return fmt.Errorf("unterminated tag")
+		}
+		name := s[:end]
+		if !allowedTags[name] {
+			return fmt.Errorf("unexpected element %q", name)
+		}
+		s = s[end:]
+
+		for {
+			s = strings.TrimLeft(s, " ")
+			if strings.HasPrefix(s, ">") {
+				s = s[1:]
+				break
+			}
+			end := strings.IndexAny(s, "= >")
+			if end <= 0 {
+				return fmt.Errorf("malformed attributes of element %q", name)
+			}
+			attribute := s[:end]
+			if !attributes[attribute] {
+				return fmt.Errorf("unexpected attribute %q of element %q", attribute, name)
+			}
+			s = s[end:]
+			if !strings.HasPrefix(s, "=") {
+				continue
+			}
+			if !strings.HasPrefix(s, `="`) {
+				return fmt.Errorf("unquoted attribute %q of element %q", attribute, name)
+			}
+			s = s[2:]
+			end = strings.IndexByte(s, '"')
+			if end == -1 {
+				return fmt.Errorf("unterminated attribute %q of element %q", attribute, name)
+			}
+			value := s[:end]
+			if strings.ContainsAny(value, "<>") {
+				return fmt.Errorf("unescaped value of attribute %q of element %q: %q", attribute, name, value)
+			}
+			if (attribute == "href" || attribute == "src" || attribute == "action") && safeURL(html.UnescapeString(value)) == "#" && value != "#" {
+				return fmt.Errorf("unsafe link in element %q: %q", name, value)
+			}
+			s = s[end+1:]
+		}
+	}
+}
+
+// fuzzPages are documents containing markup and unsafe links.
+var fuzzPages = []string{
+	"",
+	"# <script>alert(1)</script>\nText <img src=x onerror=alert(1)>\n",
+	"=> javascript:alert(1) <b>Label</b>\n=> \tJaVaScRiPt:alert(1)\n=> data:text/html,<script>alert(1)</script>\n",
+	"=> \" onmouseover=\"alert(1) Label\n=> gemini://example.org/\"><script>alert(1)</script> \"><img>\n",
+	"=> image.png \" onerror=\"alert(1)\n=> /audio.mp3 <b>\n=> video.webm </figure>\n",
+	"```<script>\n</pre><script>alert(1)</script>\n```\n```go\nfunc main() { \"</span><script>\" }\n```\n",
+	"## \"><script>\n## \"><script>\n### &amp; &lt;\n",
+	"* <li>\n> <blockquote>\n\x00\xff\xfe\n",
+}
+
+func FuzzConvert(f *testing.F) {
+	for _, page := range fuzzPages {
+		f.Add([]byte(page), "gemini://example.org/dir/page.gmi", uint8(0xff))
+	}
+	f.Add([]byte("=> x.png <svg onload=alert(1)>\n"), "javascript:alert(1)", uint8(0))
+
+	d := NewDaemon(&DaemonOptions{Address: "localhost:1967", AllowFile: true})
+
+	f.Fuzz(func(t *testing.T, page []byte, u string, flags uint8) {
+		if !utf8.ValidString(u) {
+			// URLs are provided by the caller, not by the document.
+			return
+		}
+
+		opts := &ConvertOptions{
+			URL:                  u,
+			CollapsePreformatted: flags&1 != 0,
+			Highlight:            flags&2 != 0,
+			HeadingAnchors:       flags&4 != 0,
+			EmbedMedia:           flags&8 != 0,
+		}
+		if flags&16 != 0 {
+			opts.TableOfContents = 1
+		}
+
+		for _, daemon := range []*Daemon{nil, d} {
+			var b bytes.Buffer
+			_, err := daemon.convert(&b, bytes.NewReader(page), nil, "", opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			out := b.Bytes()
+			start := bytes.Index(out, []byte("<article>"))
+			end := bytes.LastIndex(out, []byte("</article>"))
+			if start == -1 || end < start {
+				t.Fatalf("no article in output: %q", out)
+			}
+			err = checkMarkup(out[start:end], convertedTags)
+			if err != nil {
+				t.Fatalf("%s in output of %q: %q", err, page, out[start:end])
+			}
+			err = checkMarkup(out, convertedTags, pageTags)
+			if err != nil {
+				t.Fatalf("%s in output of %q", err, page)
+			}
+		}
+	})
+}
+
+func FuzzFetch(f *testing.F) {
+	f.Add("10 <script>alert(1)</script>", []byte(""))
+	f.Add("11 \"><input type=\"text\" name=\"csrf\">", []byte(""))
+	f.Add("20 text/gemini", []byte(fuzzPages[2]))
+	f.Add("20 text/gemini; lang=\"><script>alert(1)</script>", []byte(fuzzPages[1]))
+	f.Add("20 text/gemini; charset=\"<b>\"", []byte(fuzzPages[3]))
+	f.Add("20 text/gemini;lang=ar", []byte(fuzzPages[4]))
+	f.Add("20 text/html", []byte("<script>alert(1)</script>"))
+	f.Add("30 javascript:alert(1)", []byte(""))
+	f.Add("31 javascript://%0aalert(1)", []byte(""))
+	f.Add("31 //evil.example/<script>", []byte(""))
+	f.Add("51 <b>Not found</b>", []byte(""))
+	f.Add("<script>", []byte(""))
+
+	var responses sync.Map
+	var requests int
+	address := testGeminiServer(f, func(w io.Writer, request string) {
+		response, ok := responses.Load(request[strings.LastIndex(request, "/")+1:])
+		if ok {
+			w.Write(response.([]byte))
+		}
+	})
+	d := testDaemon(address, &DaemonOptions{
+		AddressBar:           true,
+		NavigationBar:        true,
+		Bookmarks:            true,
+		CollapsePreformatted: true,
+		HeadingAnchors:       true,
+		EmbedMedia:           true,
+	})
+	cookie, _ := testSession(f, d)
+
+	f.Fuzz(func(t *testing.T, header string, body []byte) {
+		if strings.ContainsAny(header, "\r\n") {
+			return
+		}
+
+		requests++
+		id := fmt.Sprintf("fuzz%d", requests)
+		responses.Store(id, append([]byte(header+"\r\n"), body...))
+		defer responses.Delete(id)
+
+		w := serve(d, "GET", "/"+id, cookie, nil)
+
+		if location := w.Header().Get("Location"); location != "" {
+			if safeURL(location) == "#" {
+				t.Fatalf("unsafe redirect to %q", location)
+			}
+			return
+		}
+
+		if mimeType, _ := mediaType([]byte(header)); len(header) > 3 && header[0] == '2' && mimeType != "text/gemini" {
+			// Content which is not converted is served in a sandbox.
+			if w.Code == 200 && w.Header().Get("Content-Security-Policy") != sandboxPolicy {
+				t.Fatalf("content of type %q is served without a sandbox", w.Header().Get("Content-Type"))
+			}
+			return
+		} else if w.Code != 200 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			// Errors are sent as plain text.
+			return
+		}
+
+		err := checkMarkup(w.Body.Bytes(), convertedTags, pageTags)
+		if err != nil {
+			t.Fatalf("%s in response to %q: %q", err, header, w.Body.String())
+		}
+	})
+}
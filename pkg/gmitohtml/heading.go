@@ -0,0 +1,92 @@
+package gmitohtml
+
+import (
+	"bufio"
+	"html/template"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// layoutIDs are the ids of elements of the page layout, which are not used
+// as heading ids.
+var layoutIDs = []string{"content", "mediatoggle", "navigationaddress", "navigationbar", "notice"}
+
+// headingEntry is a heading listed in the table of contents.
+type headingEntry struct {
+	level int
+	id    string
+	text  string
+}
+
+// slug returns the id of a heading. Letters and digits are kept, and all
+// other characters are replaced with a single dash.
+func slug(text string) string {
+	var b strings.Builder
+	var dash bool
+	for _, r := range strings.ToLower(text) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			dash = true
+			continue
+		}
+		if dash && b.Len() > 0 {
+			b.WriteByte('-')
+		}
+		dash = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// headingID returns a unique id of a heading. When a heading with the same
+// id exists, a number is appended.
+func (c *converter) headingID(text string) string {
+	id := slug(text)
+	if id == "" {
+		id = "section"
+	}
+	if c.ids == nil {
+		c.ids = make(map[string]bool)
+		c.idSuffixes = make(map[string]int)
+		for _, layoutID := range layoutIDs {
+			c.ids[layoutID] = true
+		}
+	}
+
+	unique := id
+	for c.ids[unique] {
+		c.idSuffixes[id]++
+		unique = id + "-" + strconv.Itoa(c.idSuffixes[id]+1)
+	}
+	c.ids[unique] = true
+	return unique
+}
+
+// writeTableOfContents writes a list of links to headings, nested by level.
+func writeTableOfContents(w *bufio.Writer, headings []*headingEntry) {
+	w.WriteString(`<nav aria-label="Table of contents">`)
+	var levels []int
+	for _, h := range headings {
+		switch {
+		case len(levels) == 0 || h.level > levels[len(levels)-1]:
+			w.WriteString("<ul>")
+			levels = append(levels, h.level)
+		default:
+			for len(levels) > 1 && h.level < levels[len(levels)-1] {
+				w.WriteString("</li></ul>")
+				levels = levels[:len(levels)-1]
+			}
+			w.WriteString("</li>")
+		}
+
+		w.WriteString(`<li><a href="#`)
+		template.HTMLEscape(w, []byte(h.id))
+		w.WriteString(`">`)
+		template.HTMLEscape(w, []byte(h.text))
+		w.WriteString("</a>")
+	}
+	for range levels {
+		w.WriteString("</li></ul>")
+	}
+	w.WriteString("</nav>\n")
+}
@@ -0,0 +1,85 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// Syntax highlighting styles used when the browser prefers a light or dark
+// color scheme.
+const (
+	highlightStyleLight = "github"
+	highlightStyleDark  = "monokai"
+)
+
+var highlightFormatter = html.New(html.WithClasses(true), html.PreventSurroundingPre(true))
+
+var (
+	highlightCSS     string
+	highlightCSSOnce sync.Once
+)
+
+// highlightLexer returns the lexer of the language preformatted text is
+// labeled with, or nil when the language is unknown. The language is the
+// first word of the alt text (e.g. go or python), and may also be specified
+// as a file name (e.g. main.go).
+func highlightLexer(alt string) chroma.Lexer {
+	fields := strings.Fields(alt)
+	if len(fields) == 0 || isArt(alt) {
+		return nil
+	}
+	lexer := lexers.Get(fields[0])
+	if lexer == nil {
+		return nil
+	}
+	return chroma.Coalesce(lexer)
+}
+
+// highlight writes source code as HTML with each token wrapped in a classed
+// span, styled by HighlightCSS.
+func highlight(w io.Writer, lexer chroma.Lexer, code string) error {
+	iterator, err := lexer.Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+	return highlightFormatter.Format(w, styles.Fallback, iterator)
+}
+
+// HighlightCSS returns the stylesheet of syntax highlighted preformatted
+// text. Colors follow the color scheme preferred by the browser. Background
+// colors are not included, so preformatted text keeps the background of the
+// page style.
+func HighlightCSS() string {
+	highlightCSSOnce.Do(func() {
+		var b strings.Builder
+		b.WriteString(highlightStyleCSS(highlightStyleLight))
+		b.WriteString("@media (prefers-color-scheme: dark) {\n")
+		b.WriteString(highlightStyleCSS(highlightStyleDark))
+		b.WriteString("}\n")
+		highlightCSS = b.String()
+	})
+	return highlightCSS
+}
+
+// highlightStyleCSS returns the token colors of a syntax highlighting style.
+func highlightStyleCSS(name string) string {
+	var b bytes.Buffer
+	highlightFormatter.WriteCSS(&b, styles.Get(name)) // Writing to a buffer always succeeds
+
+	var css strings.Builder
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line == "" || strings.Contains(line, ".bg {") || strings.Contains(line, ".chroma {") {
+			continue
+		}
+		css.WriteString(line)
+		css.WriteByte('\n')
+	}
+	return css.String()
+}
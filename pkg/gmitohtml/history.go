@@ -0,0 +1,388 @@
+package gmitohtml
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHistoryLimit is the default maximum number of history entries.
+const DefaultHistoryLimit = 1000
+
+// historySaveDelay is the time visited pages are recorded in memory before
+// history is saved, so that history is written at most once per delay while
+// browsing rather than on every page view.
+const historySaveDelay = 5 * time.Second
+
+// HistoryEntry is a visited page.
+type HistoryEntry struct {
+	URL   string
+	Title string
+	Time  time.Time
+}
+
+type historyStore struct {
+	entries []*HistoryEntry
+	enabled bool
+	file    string
+	limit   int
+
+	// saveTimer saves history in the background after visited pages were
+	// recorded. It is nil when no save is pending.
+	saveTimer *time.Timer
+
+	// saveLock is held while history is written, so that it is written in
+	// the order it was changed.
+	saveLock sync.Mutex
+
+	sync.Mutex
+}
+
+func newHistoryStore() *historyStore {
+	return &historyStore{
+		limit: DefaultHistoryLimit,
+	}
+}
+
+func (h *historyStore) enable(file string, limit int) error {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+
+	// Pages pending to be saved are saved to the previous file.
+	h.flushPending()
+
+	h.Lock()
+	defer h.Unlock()
+
+	// Pages visited since history was saved are newer than the file.
+	pending := h.saveTimer != nil && file == h.file
+
+	h.enabled = true
+	h.file = file
+	h.limit = limit
+
+	if file == "" || pending {
+		h.trim()
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []*HistoryEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return fmt.Errorf("failed to parse history file %s: %s", file, err)
+	}
+	h.entries = entries
+	h.trim()
+	return nil
+}
+
+func (h *historyStore) disable() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.enabled = false
+}
+
+func (h *historyStore) isEnabled() bool {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.enabled
+}
+
+func (h *historyStore) get() []*HistoryEntry {
+	h.Lock()
+	defer h.Unlock()
+
+	entries := make([]*HistoryEntry, len(h.entries))
+	for i, entry := range h.entries {
+		e := *entry
+		entries[len(h.entries)-1-i] = &e
+	}
+	return entries
+}
+
+func (h *historyStore) remove(u string) {
+	h.Lock()
+	var entries []*HistoryEntry
+	for _, entry := range h.entries {
+		if entry.URL != u {
+			entries = append(entries, entry)
+		}
+	}
+	h.entries = entries
+	h.Unlock()
+
+	// Deleted history is removed from disk immediately.
+	h.flush()
+}
+
+func (h *historyStore) clear() {
+	h.Lock()
+	h.entries = nil
+	h.Unlock()
+
+	h.flush()
+}
+
+// add records a visited page. The query of the URL is not recorded, as it
+// contains the input sent to the page, which may be sensitive (e.g. a
+// password).
+func (h *historyStore) add(u string, title string) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.enabled {
+		return
+	}
+
+	if parsed, err := url.Parse(u); err == nil && (parsed.RawQuery != "" || parsed.ForceQuery) {
+		parsed.RawQuery = ""
+		parsed.ForceQuery = false
+		u = parsed.String()
+	}
+
+	if title == "" {
+		title = u
+	}
+
+	// Visiting the same page again only updates the existing entry.
+	for i, entry := range h.entries {
+		if entry.URL == u {
+			h.entries = append(h.entries[:i], h.entries[i+1:]...)
+			break
+		}
+	}
+	h.entries = append(h.entries, &HistoryEntry{
+		URL:   u,
+		Title: title,
+		Time:  time.Now(),
+	})
+	h.trim()
+
+	if h.file != "" && h.saveTimer == nil {
+		h.saveTimer = time.AfterFunc(historySaveDelay, h.flush)
+	}
+}
+
+// trim removes the oldest entries exceeding the history limit. The caller
+// must hold the lock.
+func (h *historyStore) trim() {
+	if len(h.entries) > h.limit {
+		h.entries = h.entries[len(h.entries)-h.limit:]
+	}
+}
+
+// flush writes history to disk, including visited pages which are pending to
+// be saved. The lock must not be held.
+func (h *historyStore) flush() {
+	h.saveLock.Lock()
+	defer h.saveLock.Unlock()
+
+	h.Lock()
+	if h.saveTimer != nil {
+		h.saveTimer.Stop()
+		h.saveTimer = nil
+	}
+	file := h.file
+	out, err := json.Marshal(h.entries)
+	h.Unlock()
+
+	if file == "" {
+		return
+	} else if err != nil {
+		log.Printf("failed to marshal history: %s", err)
+		return
+	}
+
+	os.MkdirAll(path.Dir(file), 0755) // Ignore error
+
+	err = ioutil.WriteFile(file, out, 0600)
+	if err != nil {
+		log.Printf("failed to save history to %s: %s", file, err)
+	}
+}
+
+// flushPending writes history to disk when visited pages are pending to be
+// saved. The lock must not be held.
+func (h *historyStore) flushPending() {
+	h.Lock()
+	pending := h.saveTimer != nil
+	h.Unlock()
+
+	if pending {
+		h.flush()
+	}
+}
+
+// discard disables recording visited pages, without saving pages which are
+// pending to be saved.
+func (h *historyStore) discard() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.enabled = false
+	if h.saveTimer != nil {
+		h.saveTimer.Stop()
+		h.saveTimer = nil
+	}
+}
+
+func (d *Daemon) handleHistory(writer http.ResponseWriter, request *http.Request) {
+	p := d.requestProfile(request)
+
+	if request.Method == http.MethodPost {
+		if d.verifyRequest(request) != nil {
+			writeInvalidRequest(writer)
+			return
+		}
+
+		if request.PostFormValue("clear") != "" {
+			p.ClearHistory()
+		} else if deleteHistory := request.PostFormValue("delete"); deleteHistory != "" {
+			p.RemoveHistory(deleteHistory)
+		}
+
+		redirect := d.pagePath("/history")
+		if search := request.PostFormValue("search"); search != "" {
+			redirect += "?search=" + url.QueryEscape(search)
+		}
+		http.Redirect(writer, request, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if request.FormValue("clear") != "" {
+		d.writePage(writer, request, clearHistoryTemplate, "", false, nil)
+		return
+	}
+
+	type historyDay struct {
+		Date    string
+		Entries []*HistoryEntry
+	}
+
+	search := request.FormValue("search")
+	searchLower := strings.ToLower(search)
+
+	entries := p.GetHistory()
+
+	var days []*historyDay
+	for _, entry := range entries {
+		if search != "" && !strings.Contains(strings.ToLower(entry.URL), searchLower) && !strings.Contains(strings.ToLower(entry.Title), searchLower) {
+			continue
+		}
+
+		date := entry.Time.Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, &historyDay{Date: date})
+		}
+		day := days[len(days)-1]
+		day.Entries = append(day.Entries, entry)
+	}
+
+	d.writePage(writer, request, historyTemplate, "", false, &struct {
+		Search     string
+		Enabled    bool
+		HasEntries bool
+		Days       []*historyDay
+	}{
+		Search:     search,
+		Enabled:    p.history.isEnabled(),
+		HasEntries: len(entries) > 0,
+		Days:       days,
+	})
+}
+
+// EnableHistory enables recording visited pages. History is persisted to the
+// specified file, when one is provided. At most limit entries are kept.
+func (p *Profile) EnableHistory(file string, limit int) error {
+	return p.history.enable(file, limit)
+}
+
+// DisableHistory disables recording visited pages. Existing history is kept.
+func (p *Profile) DisableHistory() {
+	p.history.disable()
+}
+
+// GetHistory returns all history entries, most recent first.
+func (p *Profile) GetHistory() []*HistoryEntry {
+	return p.history.get()
+}
+
+// RemoveHistory removes all history entries of a URL.
+func (p *Profile) RemoveHistory(u string) {
+	p.history.remove(u)
+}
+
+// ClearHistory removes all history entries.
+func (p *Profile) ClearHistory() {
+	p.history.clear()
+}
+
+// EnableHistory enables recording visited pages. History is persisted to the
+// specified file, when one is provided. At most limit entries are kept.
+func (d *Daemon) EnableHistory(file string, limit int) error {
+	return d.profile.EnableHistory(file, limit)
+}
+
+// DisableHistory disables recording visited pages. Existing history is kept.
+func (d *Daemon) DisableHistory() {
+	d.profile.DisableHistory()
+}
+
+// GetHistory returns all history entries, most recent first.
+func (d *Daemon) GetHistory() []*HistoryEntry {
+	return d.profile.GetHistory()
+}
+
+// RemoveHistory removes all history entries of a URL.
+func (d *Daemon) RemoveHistory(u string) {
+	d.profile.RemoveHistory(u)
+}
+
+// ClearHistory removes all history entries.
+func (d *Daemon) ClearHistory() {
+	d.profile.ClearHistory()
+}
+
+// EnableHistory enables recording visited pages. History is persisted to the
+// specified file, when one is provided. At most limit entries are kept.
+func EnableHistory(file string, limit int) error {
+	return defaultDaemon.EnableHistory(file, limit)
+}
+
+// DisableHistory disables recording visited pages. Existing history is kept.
+func DisableHistory() {
+	defaultDaemon.DisableHistory()
+}
+
+// GetHistory returns all history entries, most recent first.
+func GetHistory() []*HistoryEntry {
+	return defaultDaemon.GetHistory()
+}
+
+// RemoveHistory removes all history entries of a URL.
+func RemoveHistory(u string) {
+	defaultDaemon.RemoveHistory(u)
+}
+
+// ClearHistory removes all history entries.
+func ClearHistory() {
+	defaultDaemon.ClearHistory()
+}
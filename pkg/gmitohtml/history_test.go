@@ -0,0 +1,96 @@
+package gmitohtml
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readHistoryFile returns the URLs of the entries saved to a history file.
+func readHistoryFile(t testing.TB, file string) []string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []*HistoryEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, entry := range entries {
+		urls = append(urls, entry.URL)
+	}
+	return urls
+}
+
+func TestHistorySaveDelayed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.json")
+	d := NewDaemon(nil)
+	err := d.EnableHistory(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := d.profile.history
+	h.add("gemini://example.org/a", "A")
+	h.add("gemini://example.org/b?secret", "B")
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("expected history not to be saved on every page view")
+	}
+
+	// Reloading history keeps pages pending to be saved.
+	err = d.EnableHistory(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(d.GetHistory()) != 2 {
+		t.Fatalf("expected pending pages to be kept, got %d entries", len(d.GetHistory()))
+	}
+	h.add("gemini://example.org/c", "C")
+
+	err = d.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := readHistoryFile(t, file)
+	if len(urls) != 3 || urls[1] != "gemini://example.org/b" {
+		t.Fatalf("expected pending pages to be saved on shutdown, got %v", urls)
+	}
+
+	// Deleted history is saved immediately.
+	d.RemoveHistory("gemini://example.org/a")
+	if urls := readHistoryFile(t, file); len(urls) != 2 {
+		t.Errorf("expected deleted page to be removed from disk, got %v", urls)
+	}
+	h.add("gemini://example.org/d", "D")
+	d.ClearHistory()
+	if urls := readHistoryFile(t, file); len(urls) != 0 {
+		t.Errorf("expected cleared history to be removed from disk, got %v", urls)
+	}
+	h.Lock()
+	pending := h.saveTimer != nil
+	h.Unlock()
+	if pending {
+		t.Error("expected no save to be pending after history was cleared")
+	}
+}
+
+func TestHistoryRemovedProfile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "alice", "history.json")
+	d := NewDaemon(nil)
+	p := d.Profile("alice")
+	err := p.EnableHistory(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.history.add("gemini://example.org/", "Example")
+	d.RemoveProfile("alice")
+	p.history.flushPending()
+	if _, err := os.Stat(filepath.Dir(file)); !os.IsNotExist(err) {
+		t.Error("expected history of removed profile not to be saved")
+	}
+}
@@ -0,0 +1,274 @@
+package gmitohtml
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCertificateChanged is the error returned when a server presents a
+// certificate other than the one trusted on first use, before that
+// certificate expired.
+var ErrCertificateChanged = errors.New("server certificate changed")
+
+// KnownHost is a server certificate trusted on first use.
+type KnownHost struct {
+	// Host is the hostname and port of the server.
+	Host string
+
+	// Fingerprint is the SHA-256 hash of the certificate, hex encoded.
+	Fingerprint string
+
+	// Expires is the time the certificate expires. A different certificate
+	// is trusted after this time.
+	Expires time.Time
+}
+
+// knownHostStore holds the server certificates trusted by a profile. It is
+// safe for concurrent use.
+type knownHostStore struct {
+	hosts map[string]*KnownHost
+	file  string
+	sync.Mutex
+}
+
+func newKnownHostStore() *knownHostStore {
+	return &knownHostStore{
+		hosts: make(map[string]*KnownHost),
+	}
+}
+
+// certificateFingerprint returns the SHA-256 hash of a certificate, hex
+// encoded.
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// load loads known hosts from a file, which known hosts are saved to when
+// they are changed. Known hosts are only loaded once from each file.
+func (s *knownHostStore) load(file string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if file == s.file {
+		return nil
+	}
+	s.file = file
+
+	if file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		s.save()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var hosts []*KnownHost
+	err = json.Unmarshal(data, &hosts)
+	if err != nil {
+		return fmt.Errorf("failed to parse known hosts file %s: %s", file, err)
+	}
+	for _, host := range hosts {
+		if host == nil || host.Host == "" || host.Fingerprint == "" {
+			continue
+		} else if _, ok := s.hosts[host.Host]; ok {
+			continue
+		}
+		s.hosts[host.Host] = host
+	}
+	return nil
+}
+
+// save writes known hosts to disk. The caller must hold the lock.
+func (s *knownHostStore) save() {
+	if s.file == "" {
+		return
+	}
+
+	out, err := json.Marshal(s.list())
+	if err != nil {
+		log.Printf("failed to marshal known hosts: %s", err)
+		return
+	}
+
+	os.MkdirAll(path.Dir(s.file), 0755) // Ignore error
+
+	err = ioutil.WriteFile(s.file, out, 0600)
+	if err != nil {
+		log.Printf("failed to save known hosts to %s: %s", s.file, err)
+	}
+}
+
+// list returns all known hosts sorted by host. The caller must hold the
+// lock.
+func (s *knownHostStore) list() []*KnownHost {
+	hosts := make([]*KnownHost, 0, len(s.hosts))
+	for _, host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts
+}
+
+// verify checks the certificate presented by a server against the one
+// trusted on first use. The certificate is trusted when the server is not
+// known yet, or when the trusted certificate expired.
+func (s *knownHostStore) verify(host string, cert *x509.Certificate) error {
+	host = strings.ToLower(host)
+	fingerprint := certificateFingerprint(cert)
+
+	s.Lock()
+	defer s.Unlock()
+
+	known, ok := s.hosts[host]
+	if ok && known.Fingerprint == fingerprint {
+		return nil
+	} else if ok && time.Now().Before(known.Expires) {
+		return fmt.Errorf("%w: %s presented certificate %s, expected %s", ErrCertificateChanged, host, fingerprint, known.Fingerprint)
+	}
+
+	s.hosts[host] = &KnownHost{
+		Host:        host,
+		Fingerprint: fingerprint,
+		Expires:     cert.NotAfter,
+	}
+	s.save()
+	return nil
+}
+
+// remove forgets the certificate trusted for a server.
+func (s *knownHostStore) remove(host string) {
+	s.Lock()
+	defer s.Unlock()
+
+	host = strings.ToLower(host)
+	if _, ok := s.hosts[host]; !ok {
+		return
+	}
+	delete(s.hosts, host)
+	s.save()
+}
+
+// writeCertificateChanged writes a page explaining that a server presented
+// a certificate other than the one trusted on first use.
+func (d *Daemon) writeCertificateChanged(writer http.ResponseWriter, request *http.Request, u string, err error) {
+	// The session cookie must be set before the header is written.
+	token := d.requestToken(d.session(writer, request))
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(http.StatusBadGateway)
+
+	writer.Write(d.renderPage(certificateChangedTemplate, d.requestProfile(request), u, false, token, &struct {
+		URL   string
+		Error string
+	}{
+		URL:   u,
+		Error: err.Error(),
+	}))
+}
+
+// handleKnownHosts trusts the next certificate presented by the server
+// hosting a page, and redirects to the page.
+func (d *Daemon) handleKnownHosts(writer http.ResponseWriter, request *http.Request) {
+	if d.verifyRequest(request) != nil {
+		writeInvalidRequest(writer)
+		return
+	}
+
+	u, err := url.Parse(request.PostFormValue("url"))
+	if err != nil || u.Scheme != "gemini" || u.Host == "" {
+		http.Error(writer, "Error: invalid URL", http.StatusBadRequest)
+		return
+	}
+	hostname, port, err := splitHostPort(u.Host)
+	if err != nil {
+		http.Error(writer, "Error: invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	d.requestProfile(request).RemoveKnownHost(net.JoinHostPort(hostname, strconv.Itoa(port)))
+	http.Redirect(writer, request, d.rewriteURL(u.String(), u), http.StatusSeeOther)
+}
+
+// LoadKnownHosts loads the server certificates trusted on first use from a
+// file, which they are saved to when they are changed. When file is empty,
+// known hosts are not saved.
+func (p *Profile) LoadKnownHosts(file string) error {
+	return p.knownHosts.load(file)
+}
+
+// GetKnownHosts returns the server certificates trusted on first use.
+func (p *Profile) GetKnownHosts() []KnownHost {
+	s := p.knownHosts
+	s.Lock()
+	defer s.Unlock()
+
+	var hosts []KnownHost
+	for _, host := range s.list() {
+		hosts = append(hosts, *host)
+	}
+	return hosts
+}
+
+// RemoveKnownHost forgets the certificate trusted for a server, specified
+// as hostname and port. The next certificate the server presents is trusted.
+func (p *Profile) RemoveKnownHost(host string) {
+	p.knownHosts.remove(host)
+}
+
+// LoadKnownHosts loads the server certificates trusted on first use from a
+// file, which they are saved to when they are changed. When file is empty,
+// known hosts are not saved.
+func (d *Daemon) LoadKnownHosts(file string) error {
+	return d.profile.LoadKnownHosts(file)
+}
+
+// GetKnownHosts returns the server certificates trusted on first use.
+func (d *Daemon) GetKnownHosts() []KnownHost {
+	return d.profile.GetKnownHosts()
+}
+
+// RemoveKnownHost forgets the certificate trusted for a server, specified
+// as hostname and port. The next certificate the server presents is trusted.
+func (d *Daemon) RemoveKnownHost(host string) {
+	d.profile.RemoveKnownHost(host)
+}
+
+// LoadKnownHosts loads the server certificates trusted on first use from a
+// file, which they are saved to when they are changed. When file is empty,
+// known hosts are not saved.
+func LoadKnownHosts(file string) error {
+	return defaultDaemon.LoadKnownHosts(file)
+}
+
+// GetKnownHosts returns the server certificates trusted on first use.
+func GetKnownHosts() []KnownHost {
+	return defaultDaemon.GetKnownHosts()
+}
+
+// RemoveKnownHost forgets the certificate trusted for a server, specified
+// as hostname and port. The next certificate the server presents is trusted.
+func RemoveKnownHost(host string) {
+	defaultDaemon.RemoveKnownHost(host)
+}
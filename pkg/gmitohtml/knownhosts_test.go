@@ -0,0 +1,107 @@
+package gmitohtml
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a new self-signed certificate.
+func testCertificate(t testing.TB) *x509.Certificate {
+	certPEM, _, err := generateSelfSignedCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("failed to decode certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestKnownHostVerify(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "knownhosts.json")
+	s := newKnownHostStore()
+	err := s.load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, other := testCertificate(t), testCertificate(t)
+	if err := s.verify("example.org:1965", cert); err != nil {
+		t.Fatalf("expected certificate to be trusted on first use, got %s", err)
+	} else if err := s.verify("Example.org:1965", cert); err != nil {
+		t.Fatalf("expected trusted certificate to be accepted, got %s", err)
+	} else if err := s.verify("example.org:1965", other); !errors.Is(err, ErrCertificateChanged) {
+		t.Fatalf("expected changed certificate to be refused, got %v", err)
+	} else if err := s.verify("example.org:1966", other); err != nil {
+		t.Fatalf("expected certificate of other port to be trusted, got %s", err)
+	}
+
+	// Known hosts are saved.
+	loaded := newKnownHostStore()
+	err = loaded.load(file)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := loaded.verify("example.org:1965", other); !errors.Is(err, ErrCertificateChanged) {
+		t.Errorf("expected loaded known host to refuse changed certificate, got %v", err)
+	}
+
+	// A new certificate is trusted after the trusted one expired.
+	s.hosts["example.org:1965"].Expires = time.Now().Add(-time.Minute)
+	if err := s.verify("example.org:1965", other); err != nil {
+		t.Errorf("expected certificate to be trusted after expiry, got %s", err)
+	}
+
+	s.remove("example.org:1965")
+	if err := s.verify("example.org:1965", cert); err != nil {
+		t.Errorf("expected certificate to be trusted after removal, got %s", err)
+	}
+}
+
+func TestKnownHostChanged(t *testing.T) {
+	address := testGeminiServer(t, staticResponse("20 text/gemini\r\n# Page\n"))
+	d := testDaemon(address, nil)
+	cookie, token := testSession(t, d)
+
+	w := serve(d, "GET", "/page.gmi", cookie, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected page to be served, got %d: %s", w.Code, w.Body.String())
+	}
+	hosts := d.GetKnownHosts()
+	if len(hosts) != 1 || hosts[0].Host != address {
+		t.Fatalf("expected %s to be known, got %+v", address, hosts)
+	}
+
+	// Simulate the server presenting a different certificate.
+	d.profile.knownHosts.hosts[address].Fingerprint = "changed"
+	w = serve(d, "GET", "/page.gmi", cookie, nil)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected changed certificate to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Known hosts are isolated between profiles.
+	_, _, body, err := d.fetchResponse(d.Profile("alice"), "gemini://"+address+"/page.gmi")
+	if err != nil {
+		t.Fatalf("expected other profile to trust certificate, got %s", err)
+	}
+	body.Close()
+
+	w = serve(d, "POST", "/knownhosts", cookie, url.Values{csrfField: {token}, "url": {"gemini://" + address + "/page.gmi"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect, got %d: %s", w.Code, w.Body.String())
+	}
+	w = serve(d, "GET", "/page.gmi", cookie, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected new certificate to be trusted, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,34 @@
+package gmitohtml
+
+import (
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// rtlScripts are the scripts written from right to left.
+var rtlScripts = []string{"Adlm", "Arab", "Hebr", "Mand", "Mend", "Nkoo", "Rohg", "Samr", "Syrc", "Thaa", "Yezi"}
+
+// pageLanguage returns the language and text direction of a page in the
+// languages specified by a lang parameter. When several languages are
+// specified, the first is used. An empty language is returned when the
+// language is invalid.
+func pageLanguage(lang string) (string, string) {
+	lang = strings.TrimSpace(strings.SplitN(lang, ",", 2)[0])
+	if lang == "" {
+		return "", ""
+	}
+
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return "", ""
+	}
+
+	script, _ := tag.Script()
+	for _, rtl := range rtlScripts {
+		if script.String() == rtl {
+			return tag.String(), "rtl"
+		}
+	}
+	return tag.String(), ""
+}
@@ -0,0 +1,211 @@
+package gmitohtml
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// unixAddressPrefix is the prefix of addresses of Unix domain sockets.
+	unixAddressPrefix = "unix:"
+
+	// systemdAddress is the address used to listen on a socket passed by
+	// systemd socket activation.
+	systemdAddress = "systemd"
+
+	// systemdFirstFD is the first file descriptor passed by systemd.
+	systemdFirstFD = 3
+)
+
+// ErrNoSystemdSocket is the error returned when the daemon is configured to
+// use systemd socket activation, but no socket was passed.
+var ErrNoSystemdSocket = errors.New("no socket passed by systemd")
+
+// selfSignedValidity is the validity period of self-signed certificates.
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
+// tlsEnabled returns whether requests are served via HTTPS.
+func (o *DaemonOptions) tlsEnabled() bool {
+	return o.SelfSigned || (o.CertFile != "" && o.KeyFile != "")
+}
+
+// scheme returns the scheme requests are served via.
+func (o *DaemonOptions) scheme() string {
+	if o.tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// listen returns a listener on the daemon address.
+func (d *Daemon) listen() (net.Listener, error) {
+	options := d.getOptions()
+
+	var (
+		listener net.Listener
+		err      error
+	)
+	switch {
+	case options.Address == systemdAddress:
+		listener, err = systemdListener()
+	case strings.HasPrefix(options.Address, unixAddressPrefix):
+		listener, err = unixListener(strings.TrimPrefix(options.Address, unixAddressPrefix))
+	default:
+		listener, err = net.Listen("tcp", options.Address)
+	}
+	if err != nil || !options.tlsEnabled() {
+		return listener, err
+	}
+
+	cert, err := loadServerCertificate(&options)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+// unixListener listens on a Unix domain socket. A stale socket left behind
+// by a previous daemon is removed.
+func unixListener(file string) (net.Listener, error) {
+	info, err := os.Lstat(file)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", file)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is already in use", file)
+		}
+		os.Remove(file) // Ignore error
+	}
+	return net.Listen("unix", file)
+}
+
+// systemdListener returns a listener on the first socket passed by systemd
+// socket activation.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, ErrNoSystemdSocket
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, ErrNoSystemdSocket
+	}
+
+	// Prevent child processes from using the sockets.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(systemdFirstFD), "systemd")
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+// loadServerCertificate loads the certificate requests are served with. When
+// a self-signed certificate is requested and the certificate files do not
+// exist, a certificate is generated and saved to the files, if specified.
+func loadServerCertificate(options *DaemonOptions) (tls.Certificate, error) {
+	if options.SelfSigned {
+		_, certErr := os.Stat(options.CertFile)
+		_, keyErr := os.Stat(options.KeyFile)
+		if options.CertFile == "" || options.KeyFile == "" || os.IsNotExist(certErr) || os.IsNotExist(keyErr) {
+			certPEM, keyPEM, err := generateSelfSignedCertificate(options.Address)
+			if err != nil {
+				return tls.Certificate{}, fmt.Errorf("failed to generate certificate: %s", err)
+			}
+
+			if options.CertFile != "" && options.KeyFile != "" {
+				os.MkdirAll(path.Dir(options.CertFile), 0755) // Ignore error
+				os.MkdirAll(path.Dir(options.KeyFile), 0755)  // Ignore error
+
+				err = ioutil.WriteFile(options.CertFile, certPEM, 0644)
+				if err == nil {
+					err = ioutil.WriteFile(options.KeyFile, keyPEM, 0600)
+				}
+				if err != nil {
+					return tls.Certificate{}, fmt.Errorf("failed to save certificate: %s", err)
+				}
+			}
+			return tls.X509KeyPair(certPEM, keyPEM)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate: %s", err)
+	}
+	return cert, nil
+}
+
+// generateSelfSignedCertificate generates a self-signed certificate valid for
+// localhost, the local hostname and the host of the daemon address.
+func generateSelfSignedCertificate(address string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "gmitohtml"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else if host != "localhost" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,249 @@
+package gmitohtml
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// mediaExtensions are the media types of links embedded as images, audio or
+// video, by file extension.
+var mediaExtensions = map[string]string{
+	".bmp":  "image/bmp",
+	".gif":  "image/gif",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+
+	".mp4":  "video/mp4",
+	".ogv":  "video/ogg",
+	".webm": "video/webm",
+}
+
+// maxMediaEntries is the maximum number of media types cached, and of pages
+// media embedding is toggled on, per profile.
+const maxMediaEntries = 1000
+
+// mediaElement returns the element content of the specified media type is
+// embedded as, or an empty string when it is not embedded.
+func mediaElement(mediaType string) string {
+	if !passiveType(mediaType) {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return "img"
+	case strings.HasPrefix(mediaType, "audio/"):
+		return "audio"
+	case strings.HasPrefix(mediaType, "video/"):
+		return "video"
+	}
+	return ""
+}
+
+// linkMedia returns the element a link is embedded as, or an empty string
+// when it is not embedded. Only links to the server of the document or to
+// local files are embedded, as other links are not served by the daemon, or
+// relative and HTTP(S) links when converting without a daemon.
+func (c *converter) linkMedia(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+
+	if c.d == nil {
+		if u.IsAbs() && u.Scheme != "http" && u.Scheme != "https" {
+			return ""
+		}
+	} else {
+		if c.loc != nil {
+			u = c.loc.ResolveReference(u)
+		}
+		switch u.Scheme {
+		case "gemini":
+			if c.loc == nil || !strings.EqualFold(u.Host, c.loc.Host) {
+				return ""
+			}
+		case "file":
+			if !c.d.getOptions().AllowFile {
+				return ""
+			}
+		default:
+			return ""
+		}
+	}
+
+	var mediaType string
+	if c.opts.MediaType != nil {
+		mediaType = c.opts.MediaType(u.String())
+	}
+	if mediaType == "" {
+		mediaType = mediaExtensions[strings.ToLower(path.Ext(u.Path))]
+	}
+	return mediaElement(mediaType)
+}
+
+// embedMedia converts a link to an image, audio or video element, captioned
+// with the link.
+func (c *converter) embedMedia(element string, link []byte, label []byte) {
+	w := c.w
+	src := []byte(safeURL(c.d.rewriteURL(string(link), c.loc)))
+	w.WriteString("<figure><")
+	w.WriteString(element)
+	w.WriteString(` src="`)
+	template.HTMLEscape(w, src)
+	if element == "img" {
+		w.WriteString(`" alt="`)
+		template.HTMLEscape(w, label)
+		w.WriteString(`" loading="lazy">`)
+	} else {
+		w.WriteString(`" controls preload="none" aria-label="`)
+		template.HTMLEscape(w, label)
+		w.WriteString(`"></`)
+		w.WriteString(element)
+		w.WriteByte('>')
+	}
+	w.WriteString(`<figcaption><a href="`)
+	template.HTMLEscape(w, src)
+	w.WriteString(`">`)
+	template.HTMLEscape(w, label)
+	w.WriteString("</a></figcaption></figure>\n")
+}
+
+// mediaTypeCache holds the media types of content fetched by the daemon for
+// a user, which are used to embed links regardless of their file extension.
+// Each profile has a separate cache, so users cannot tell which pages other
+// users visited.
+type mediaTypeCache struct {
+	types map[string]string
+	order []string
+	sync.Mutex
+}
+
+func newMediaTypeCache() *mediaTypeCache {
+	return &mediaTypeCache{
+		types: make(map[string]string),
+	}
+}
+
+// add records the media type of content. The oldest entry is removed when
+// the cache is full.
+func (c *mediaTypeCache) add(u string, mediaType string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.types[u]; !ok {
+		if len(c.order) >= maxMediaEntries {
+			delete(c.types, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, u)
+	}
+	c.types[u] = mediaType
+}
+
+// get returns the media type of content, or an empty string when it has not
+// been fetched.
+func (c *mediaTypeCache) get(u string) string {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.types[u]
+}
+
+// mediaStore holds the pages media embedding is toggled on by a user. Pages
+// are not saved, and the oldest page is removed when the store is full.
+type mediaStore struct {
+	pages map[string]bool
+	order []string
+	sync.Mutex
+}
+
+func newMediaStore() *mediaStore {
+	return &mediaStore{
+		pages: make(map[string]bool),
+	}
+}
+
+// set sets whether media is embedded in a page.
+func (s *mediaStore) set(u string, embed bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.pages[u]; !ok {
+		if len(s.order) >= maxMediaEntries {
+			delete(s.pages, s.order[0])
+			s.order = s.order[1:]
+		}
+		s.order = append(s.order, u)
+	}
+	s.pages[u] = embed
+}
+
+// embed returns whether media is embedded in a page, or the default when it
+// has not been toggled.
+func (s *mediaStore) embed(u string, defaultEmbed bool) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	embed, ok := s.pages[u]
+	if !ok {
+		return defaultEmbed
+	}
+	return embed
+}
+
+// mediaOptions sets the media options of a page converted for the user of a
+// profile.
+func (d *Daemon) mediaOptions(opts *ConvertOptions, p *Profile) {
+	options := d.getOptions()
+	opts.EmbedMedia = p.media.embed(opts.URL, options.EmbedMedia)
+	if options.SniffMedia {
+		opts.MediaType = p.mediaTypes.get
+	}
+}
+
+// recordMediaType records the media type of content fetched by the daemon
+// for the user of a profile when media types are sniffed.
+func (d *Daemon) recordMediaType(p *Profile, u string, mediaType string) {
+	if d.getOptions().SniffMedia {
+		p.mediaTypes.add(u, mediaType)
+	}
+}
+
+// mediaToggle returns the button toggling media embedding in a page.
+func (d *Daemon) mediaToggle(token string, opts *ConvertOptions) *formButton {
+	if opts.EmbedMedia {
+		return newFormButton(token, d.pagePath("/media"), "Hide media", "url", opts.URL, "embed", "0")
+	}
+	return newFormButton(token, d.pagePath("/media"), "Show media", "url", opts.URL, "embed", "1")
+}
+
+// handleMedia toggles media embedding in a page.
+func (d *Daemon) handleMedia(writer http.ResponseWriter, request *http.Request) {
+	if d.verifyRequest(request) != nil {
+		writeInvalidRequest(writer)
+		return
+	}
+
+	u, err := url.Parse(request.PostFormValue("url"))
+	if err != nil || !((u.Scheme == "gemini" && u.Host != "") || (u.Scheme == "file" && u.Path != "")) {
+		http.Error(writer, "Error: invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	d.requestProfile(request).media.set(u.String(), request.PostFormValue("embed") == "1")
+	http.Redirect(writer, request, d.rewriteURL(u.String(), u), http.StatusSeeOther)
+}
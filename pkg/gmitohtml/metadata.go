@@ -0,0 +1,79 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDescriptionLength is the maximum length of a description in characters.
+const maxDescriptionLength = 200
+
+// maxMetadataLines is the number of lines at the start of a document the
+// metadata of a page is read from when converting.
+const maxMetadataLines = 100
+
+// Metadata is the metadata of a Gemini page.
+type Metadata struct {
+	// Title is the text of the first heading.
+	Title string
+
+	// Description is the first line of text which is not a heading, link,
+	// list item, quote or preformatted text.
+	Description string
+}
+
+// ParseMetadata returns the metadata of a Gemini page.
+func ParseMetadata(page []byte) *Metadata {
+	p := &metadataParser{meta: &Metadata{}}
+	scanner := newLineScanner(bytes.NewReader(page))
+	for scanner.Scan() {
+		if p.line(scanner.Bytes()) {
+			break
+		}
+	}
+	return p.meta
+}
+
+// metadataParser reads metadata from the lines of a Gemini page.
+type metadataParser struct {
+	meta         *Metadata
+	preformatted bool
+}
+
+// line reads metadata from a line. It returns whether all metadata was
+// read.
+func (p *metadataParser) line(line []byte) bool {
+	if bytes.HasPrefix(line, []byte("```")) {
+		p.preformatted = !p.preformatted
+	} else if !p.preformatted {
+		switch {
+		case bytes.HasPrefix(line, []byte("#")):
+			if p.meta.Title == "" {
+				p.meta.Title = string(bytes.TrimSpace(bytes.TrimLeft(line, "#")))
+			}
+		case bytes.HasPrefix(line, []byte("=>")), bytes.HasPrefix(line, []byte("* ")), bytes.HasPrefix(line, []byte(">")):
+		default:
+			if p.meta.Description == "" {
+				p.meta.Description = description(string(line))
+			}
+		}
+	}
+	return p.meta.Title != "" && p.meta.Description != ""
+}
+
+// description returns a line of text shortened to maxDescriptionLength
+// characters, ending at a word boundary.
+func description(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= maxDescriptionLength {
+		return text
+	}
+
+	runes := []rune(text)[:maxDescriptionLength]
+	short := string(runes)
+	if i := strings.LastIndex(short, " "); i > 0 {
+		short = short[:i]
+	}
+	return short + "…"
+}
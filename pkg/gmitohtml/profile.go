@@ -0,0 +1,158 @@
+package gmitohtml
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Profile holds the bookmarks, client certificates, known hosts, history
+// and subscriptions of a user. When authentication is disabled, all clients
+// share the default profile, which is also accessed via the methods of
+// Daemon.
+type Profile struct {
+	name   string
+	daemon *Daemon
+
+	clientCerts   *certStore
+	knownHosts    *knownHostStore
+	bookmarks     *bookmarkStore
+	history       *historyStore
+	subscriptions *subscriptionStore
+	media         *mediaStore
+	mediaTypes    *mediaTypeCache
+
+	loadOnce sync.Once
+}
+
+// userContextKey is the request context key of the authenticated user.
+type userContextKey struct{}
+
+func newProfile(d *Daemon, name string) *Profile {
+	return &Profile{
+		name:          name,
+		daemon:        d,
+		clientCerts:   newCertStore(),
+		knownHosts:    newKnownHostStore(),
+		bookmarks:     newBookmarkStore(),
+		history:       newHistoryStore(),
+		subscriptions: newSubscriptionStore(),
+		media:         newMediaStore(),
+		mediaTypes:    newMediaTypeCache(),
+	}
+}
+
+// Name returns the name of the user of the profile, or an empty string for
+// the default profile.
+func (p *Profile) Name() string {
+	return p.name
+}
+
+// Profile returns the profile of a user, creating it when necessary. When
+// name is empty, the default profile is returned.
+func (d *Daemon) Profile(name string) *Profile {
+	if name == "" {
+		return d.profile
+	}
+
+	d.profileLock.Lock()
+	p, ok := d.profiles[name]
+	if !ok {
+		p = newProfile(d, name)
+		d.profiles[name] = p
+	}
+	onCreated := d.onProfileCreated
+	d.profileLock.Unlock()
+
+	// Other requests wait until the profile is loaded.
+	p.loadOnce.Do(func() {
+		if d.getOptions().Bookmarks {
+			for u, label := range defaultBookmarks {
+				p.AddBookmark(u, label)
+			}
+		}
+		if onCreated != nil {
+			onCreated(p)
+		}
+	})
+	return p
+}
+
+// Profiles returns the names of the users profiles were created for.
+func (d *Daemon) Profiles() []string {
+	d.profileLock.Lock()
+	defer d.profileLock.Unlock()
+
+	names := make([]string, 0, len(d.profiles))
+	for name := range d.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RemoveProfile removes the profile of a user.
+func (d *Daemon) RemoveProfile(name string) {
+	d.profileLock.Lock()
+	p, ok := d.profiles[name]
+	delete(d.profiles, name)
+	onRemoved := d.onProfileRemoved
+	d.profileLock.Unlock()
+
+	if !ok {
+		return
+	}
+	// History pending to be saved must not be saved after the profile was
+	// removed.
+	p.history.discard()
+	if onRemoved != nil {
+		onRemoved(p)
+	}
+}
+
+// SetOnProfileCreated sets the function called when a profile is created,
+// before it is used. This allows loading the data of the profile. The
+// function must not request the same profile via Daemon.Profile.
+func (d *Daemon) SetOnProfileCreated(f func(p *Profile)) {
+	d.profileLock.Lock()
+	d.onProfileCreated = f
+	d.profileLock.Unlock()
+}
+
+// SetOnProfileRemoved sets the function called when a profile is removed.
+func (d *Daemon) SetOnProfileRemoved(f func(p *Profile)) {
+	d.profileLock.Lock()
+	d.onProfileRemoved = f
+	d.profileLock.Unlock()
+}
+
+// allProfiles returns the default profile and the profiles of all users.
+func (d *Daemon) allProfiles() []*Profile {
+	d.profileLock.Lock()
+	defer d.profileLock.Unlock()
+
+	profiles := []*Profile{d.profile}
+	for _, p := range d.profiles {
+		profiles = append(profiles, p)
+	}
+	return profiles
+}
+
+// requestUser returns the name of the user a request was authenticated as,
+// or an empty string when authentication is disabled.
+func requestUser(request *http.Request) string {
+	user, _ := request.Context().Value(userContextKey{}).(string)
+	return user
+}
+
+// withUser returns a request authenticated as a user.
+func withUser(request *http.Request, user string) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), userContextKey{}, user))
+}
+
+// requestProfile returns the profile of the user a request was
+// authenticated as.
+func (d *Daemon) requestProfile(request *http.Request) *Profile {
+	return d.Profile(requestUser(request))
+}
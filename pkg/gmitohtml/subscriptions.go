@@ -0,0 +1,569 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSubscriptionInterval is the default time between subscription updates.
+const DefaultSubscriptionInterval = time.Hour
+
+// maxSubscriptionEntries is the maximum number of entries kept in the timeline.
+const maxSubscriptionEntries = 1000
+
+type subscriptionEntry struct {
+	*FeedEntry
+
+	Subscription string
+	FeedTitle    string
+	Seen         time.Time
+}
+
+// key returns the key identifying a timeline entry.
+func (e *subscriptionEntry) key() timelineKey {
+	return timelineKey{Subscription: e.Subscription, URL: e.URL}
+}
+
+// timelineKey identifies a timeline entry. Entries are identified by
+// subscription and URL, as several subscriptions may link to the same URL.
+type timelineKey struct {
+	Subscription string
+	URL          string
+}
+
+type subscriptionStore struct {
+	subscriptions map[string]string
+	entries       map[timelineKey]*subscriptionEntry
+
+	// trimmed holds the entries removed from the timeline when it was full,
+	// which are not added again while they remain in their feed.
+	trimmed map[timelineKey]bool
+
+	file      string
+	onChanged func()
+	sync.Mutex
+}
+
+func newSubscriptionStore() *subscriptionStore {
+	return &subscriptionStore{
+		subscriptions: make(map[string]string),
+		entries:       make(map[timelineKey]*subscriptionEntry),
+		trimmed:       make(map[timelineKey]bool),
+	}
+}
+
+// load loads timeline entries from a file, which the timeline is saved to
+// when it is changed. Entries of removed subscriptions are not loaded. The
+// timeline is only loaded once from each file.
+func (s *subscriptionStore) load(file string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if file == s.file {
+		return nil
+	}
+	s.file = file
+
+	if file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		s.save()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []*subscriptionEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return fmt.Errorf("failed to parse timeline file %s: %s", file, err)
+	}
+	for _, entry := range entries {
+		if entry.FeedEntry == nil {
+			continue
+		} else if _, ok := s.subscriptions[entry.Subscription]; !ok {
+			continue
+		}
+
+		existing, ok := s.entries[entry.key()]
+		if ok {
+			// Keep the time the entry was first seen.
+			existing.Seen = entry.Seen
+			continue
+		}
+		s.entries[entry.key()] = entry
+	}
+	return nil
+}
+
+// save writes the timeline to disk. The caller must hold the lock.
+func (s *subscriptionStore) save() {
+	if s.file == "" {
+		return
+	}
+
+	out, err := json.Marshal(s.timeline())
+	if err != nil {
+		log.Printf("failed to marshal timeline: %s", err)
+		return
+	}
+
+	os.MkdirAll(path.Dir(s.file), 0755) // Ignore error
+
+	err = ioutil.WriteFile(s.file, out, 0600)
+	if err != nil {
+		log.Printf("failed to save timeline to %s: %s", s.file, err)
+	}
+}
+
+// fetchFeed downloads and parses a Gemini page or Atom feed using the client
+// certificates of a profile.
+func (d *Daemon) fetchFeed(p *Profile, u string) (*Feed, error) {
+	requestURL, header, body, err := d.fetchResponse(p, u)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if !bytes.HasPrefix(header, []byte("2")) {
+		return nil, fmt.Errorf("server sent unexpected header: %s", header)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	mimeType, params := mediaType(header)
+	switch mimeType {
+	case "text/gemini":
+		return ParseFeed(decodeCharset(data, params["charset"]), requestURL.String()), nil
+	case "application/atom+xml", "application/xml", "text/xml":
+		return ParseAtom(data, requestURL.String())
+	default:
+		return nil, fmt.Errorf("unsupported feed type: %s", mimeType)
+	}
+}
+
+// updateSubscription fetches a subscription and adds new entries to the
+// timeline.
+func (p *Profile) updateSubscription(u string) error {
+	feed, err := p.daemon.fetchFeed(p, u)
+	if err != nil {
+		return err
+	}
+
+	s := p.subscriptions
+	s.Lock()
+	defer s.Unlock()
+
+	label, ok := s.subscriptions[u]
+	if !ok {
+		return nil // Subscription was removed while fetching
+	}
+	if label == "" || label == u {
+		label = feed.Title
+	}
+
+	var changed bool
+	now := time.Now()
+	inFeed := make(map[string]bool, len(feed.Entries))
+	for _, entry := range feed.Entries {
+		inFeed[entry.URL] = true
+		key := timelineKey{Subscription: u, URL: entry.URL}
+		if s.trimmed[key] {
+			continue
+		}
+
+		existing, ok := s.entries[key]
+		if ok {
+			if existing.Title != entry.Title || !existing.Updated.Equal(entry.Updated) || existing.FeedTitle != label {
+				changed = true
+			}
+			existing.FeedEntry = entry
+			existing.FeedTitle = label
+			continue
+		}
+		s.entries[key] = &subscriptionEntry{
+			FeedEntry:    entry,
+			Subscription: u,
+			FeedTitle:    label,
+			Seen:         now,
+		}
+		changed = true
+	}
+
+	// Trimmed entries are forgotten once they are removed from their feed.
+	for key := range s.trimmed {
+		if key.Subscription == u && !inFeed[key.URL] {
+			delete(s.trimmed, key)
+		}
+	}
+
+	if len(s.entries) > maxSubscriptionEntries {
+		timeline := s.timeline()
+		for _, entry := range timeline[maxSubscriptionEntries:] {
+			delete(s.entries, entry.key())
+			s.trimmed[entry.key()] = true
+		}
+		changed = true
+	}
+
+	if changed {
+		s.save()
+	}
+	return nil
+}
+
+// timeline returns all timeline entries in reverse chronological order. The
+// caller must hold the lock.
+func (s *subscriptionStore) timeline() []*subscriptionEntry {
+	timeline := make([]*subscriptionEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		timeline = append(timeline, entry)
+	}
+	sort.Slice(timeline, func(i, j int) bool {
+		if !timeline[i].Updated.Equal(timeline[j].Updated) {
+			return timeline[i].Updated.After(timeline[j].Updated)
+		}
+		return timeline[i].Seen.After(timeline[j].Seen)
+	})
+	return timeline
+}
+
+// startPolling starts updating subscriptions in the background, unless
+// already started or subscriptions are disabled. Polling is started again
+// after the daemon was shut down.
+func (d *Daemon) startPolling() {
+	if !d.getOptions().Subscriptions {
+		return
+	}
+
+	d.pollLock.Lock()
+	defer d.pollLock.Unlock()
+
+	if d.polling {
+		return
+	}
+	d.polling = true
+	d.stopPolling = make(chan struct{})
+	go d.pollSubscriptions(d.pollInterval, d.stopPolling)
+}
+
+// pollSubscriptions updates the subscriptions of all profiles periodically
+// until stop is closed when the daemon is shut down. Subscriptions are not
+// updated while they are disabled.
+func (d *Daemon) pollSubscriptions(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		var profiles []*Profile
+		if d.getOptions().Subscriptions {
+			profiles = d.allProfiles()
+		}
+		for _, p := range profiles {
+			s := p.subscriptions
+			s.Lock()
+			var allURLs []string
+			for u := range s.subscriptions {
+				allURLs = append(allURLs, u)
+			}
+			s.Unlock()
+
+			for _, u := range allURLs {
+				err := p.updateSubscription(u)
+				if err != nil {
+					log.Printf("failed to update subscription %s: %s", u, err)
+				}
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// isPolling returns whether subscriptions are updated in the background.
+func (d *Daemon) isPolling() bool {
+	d.pollLock.Lock()
+	defer d.pollLock.Unlock()
+
+	return d.polling
+}
+
+func (d *Daemon) handleSubscriptions(writer http.ResponseWriter, request *http.Request) {
+	p := d.requestProfile(request)
+
+	if request.Method == http.MethodPost {
+		if d.verifyRequest(request) != nil {
+			writeInvalidRequest(writer)
+			return
+		}
+
+		if deleteSubscription := request.PostFormValue("delete"); deleteSubscription != "" {
+			p.RemoveSubscription(deleteSubscription)
+		} else if postAddress := request.PostFormValue("address"); postAddress != "" {
+			if _, err := subscriptionURL(postAddress); err != nil {
+				http.Error(writer, fmt.Sprintf("Error: failed to subscribe to %s: %s", postAddress, err), http.StatusBadRequest)
+				return
+			}
+			p.AddSubscription(postAddress, request.PostFormValue("label"))
+		}
+		http.Redirect(writer, request, d.pagePath("/subscriptions"), http.StatusSeeOther)
+		return
+	}
+
+	deleteSubscription := request.FormValue("delete")
+	if deleteSubscription != "" {
+		label, ok := p.GetSubscriptions()[deleteSubscription]
+		if !ok {
+			http.Error(writer, "Error: subscription not found", http.StatusNotFound)
+			return
+		}
+		if label == "" {
+			label = deleteSubscription
+		}
+
+		d.writePage(writer, request, unsubscribeTemplate, "", false, &struct {
+			URL   string
+			Label string
+		}{
+			URL:   deleteSubscription,
+			Label: label,
+		})
+		return
+	}
+
+	type timelineDay struct {
+		Date    string
+		Entries []subscriptionEntry
+	}
+
+	type subscription struct {
+		URL   string
+		Label string
+	}
+
+	var timeline []*timelineDay
+	var subscriptions []*subscription
+
+	s := p.subscriptions
+	s.Lock()
+	for _, entry := range s.timeline() {
+		date := entry.Updated.Format(feedDateLayout)
+		if len(timeline) == 0 || timeline[len(timeline)-1].Date != date {
+			timeline = append(timeline, &timelineDay{Date: date})
+		}
+		day := timeline[len(timeline)-1]
+		day.Entries = append(day.Entries, *entry)
+	}
+
+	for u, label := range s.subscriptions {
+		if label == "" {
+			label = u
+		}
+		subscriptions = append(subscriptions, &subscription{URL: u, Label: label})
+	}
+	s.Unlock()
+
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].URL < subscriptions[j].URL
+	})
+
+	d.writePage(writer, request, subscriptionsTemplate, "", false, &struct {
+		Timeline      []*timelineDay
+		Subscriptions []*subscription
+	}{
+		Timeline:      timeline,
+		Subscriptions: subscriptions,
+	})
+}
+
+// SetOnSubscriptionsChanged sets the function called when a subscription is
+// changed.
+func (p *Profile) SetOnSubscriptionsChanged(f func()) {
+	p.subscriptions.Lock()
+	p.subscriptions.onChanged = f
+	p.subscriptions.Unlock()
+}
+
+// subscriptionURL returns the normalized URL of a subscription. Addresses
+// without a scheme are Gemini URLs. ErrInvalidURL is returned when the URL is
+// not a Gemini URL.
+func subscriptionURL(u string) (string, error) {
+	if !strings.Contains(u, "://") {
+		u = "gemini://" + u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "gemini" || parsed.Host == "" {
+		return "", ErrInvalidURL
+	}
+	parsed.Host = strings.ToLower(parsed.Host)
+	return parsed.String(), nil
+}
+
+// AddSubscription subscribes to a Gemini page or Atom feed. Subscriptions to
+// URLs other than Gemini URLs are ignored.
+func (p *Profile) AddSubscription(u string, label string) {
+	normalized, err := subscriptionURL(u)
+	if err != nil {
+		log.Printf("failed to add subscription %s: %s", u, err)
+		return
+	}
+	u = normalized
+
+	s := p.subscriptions
+	s.Lock()
+	s.subscriptions[u] = label
+	onChanged := s.onChanged
+	s.Unlock()
+
+	if p.daemon.isPolling() {
+		go func() {
+			err := p.updateSubscription(u)
+			if err != nil {
+				log.Printf("failed to update subscription %s: %s", u, err)
+			}
+		}()
+	}
+
+	if onChanged != nil {
+		onChanged()
+	}
+}
+
+// LoadTimeline loads the subscriptions timeline from a file, which the
+// timeline is saved to when it is changed. When file is empty, the timeline
+// is not saved.
+func (p *Profile) LoadTimeline(file string) error {
+	return p.subscriptions.load(file)
+}
+
+// GetSubscriptions returns all subscriptions.
+func (p *Profile) GetSubscriptions() map[string]string {
+	s := p.subscriptions
+	s.Lock()
+	defer s.Unlock()
+
+	subscriptions := make(map[string]string, len(s.subscriptions))
+	for u, label := range s.subscriptions {
+		subscriptions[u] = label
+	}
+	return subscriptions
+}
+
+// RemoveSubscription removes a subscription and its timeline entries.
+func (p *Profile) RemoveSubscription(u string) {
+	s := p.subscriptions
+	s.Lock()
+	delete(s.subscriptions, u)
+	for key := range s.entries {
+		if key.Subscription == u {
+			delete(s.entries, key)
+		}
+	}
+	for key := range s.trimmed {
+		if key.Subscription == u {
+			delete(s.trimmed, key)
+		}
+	}
+	s.save()
+	onChanged := s.onChanged
+	s.Unlock()
+
+	if onChanged != nil {
+		onChanged()
+	}
+}
+
+// SetOnSubscriptionsChanged sets the function called when a subscription is
+// changed.
+func (d *Daemon) SetOnSubscriptionsChanged(f func()) {
+	d.profile.SetOnSubscriptionsChanged(f)
+}
+
+// SetSubscriptionInterval sets the time between subscription updates. This
+// must be called before the daemon is started.
+func (d *Daemon) SetSubscriptionInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSubscriptionInterval
+	}
+
+	d.pollLock.Lock()
+	d.pollInterval = interval
+	d.pollLock.Unlock()
+}
+
+// AddSubscription subscribes to a Gemini page or Atom feed. Subscriptions to
+// URLs other than Gemini URLs are ignored.
+func (d *Daemon) AddSubscription(u string, label string) {
+	d.profile.AddSubscription(u, label)
+}
+
+// LoadTimeline loads the subscriptions timeline from a file, which the
+// timeline is saved to when it is changed. When file is empty, the timeline
+// is not saved.
+func (d *Daemon) LoadTimeline(file string) error {
+	return d.profile.LoadTimeline(file)
+}
+
+// GetSubscriptions returns all subscriptions.
+func (d *Daemon) GetSubscriptions() map[string]string {
+	return d.profile.GetSubscriptions()
+}
+
+// RemoveSubscription removes a subscription and its timeline entries.
+func (d *Daemon) RemoveSubscription(u string) {
+	d.profile.RemoveSubscription(u)
+}
+
+// SetOnSubscriptionsChanged sets the function called when a subscription is
+// changed.
+func SetOnSubscriptionsChanged(f func()) {
+	defaultDaemon.SetOnSubscriptionsChanged(f)
+}
+
+// SetSubscriptionInterval sets the time between subscription updates. This
+// must be called before the daemon is started.
+func SetSubscriptionInterval(interval time.Duration) {
+	defaultDaemon.SetSubscriptionInterval(interval)
+}
+
+// AddSubscription subscribes to a Gemini page or Atom feed. Subscriptions to
+// URLs other than Gemini URLs are ignored.
+func AddSubscription(u string, label string) {
+	defaultDaemon.AddSubscription(u, label)
+}
+
+// LoadTimeline loads the subscriptions timeline from a file, which the
+// timeline is saved to when it is changed. When file is empty, the timeline
+// is not saved.
+func LoadTimeline(file string) error {
+	return defaultDaemon.LoadTimeline(file)
+}
+
+// GetSubscriptions returns all subscriptions.
+func GetSubscriptions() map[string]string {
+	return defaultDaemon.GetSubscriptions()
+}
+
+// RemoveSubscription removes a subscription and its timeline entries.
+func RemoveSubscription(u string) {
+	defaultDaemon.RemoveSubscription(u)
+}
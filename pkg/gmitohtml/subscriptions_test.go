@@ -0,0 +1,117 @@
+package gmitohtml
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFeed returns a gemlog index page linking to n dated entries.
+func testFeed(n int) string {
+	var b strings.Builder
+	b.WriteString("20 text/gemini\r\n# Gemlog\n")
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "=> /entry%d.gmi %s Entry %d\n", i, day.AddDate(0, 0, i).Format("2006-01-02"), i)
+	}
+	return b.String()
+}
+
+func TestSubscriptionTrim(t *testing.T) {
+	address := testGeminiServer(t, staticResponse(testFeed(maxSubscriptionEntries+10)))
+	d := NewDaemon(nil)
+	file := filepath.Join(t.TempDir(), "timeline.json")
+	err := d.LoadTimeline(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := "gemini://" + address + "/gemlog/"
+	d.AddSubscription(u, "")
+	err = d.profile.updateSubscription(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.profile.subscriptions
+	if len(s.entries) != maxSubscriptionEntries {
+		t.Fatalf("expected %d entries, got %d", maxSubscriptionEntries, len(s.entries))
+	} else if _, ok := s.entries[timelineKey{u, "gemini://" + address + "/entry0.gmi"}]; ok {
+		t.Fatal("expected oldest entry to be trimmed")
+	}
+
+	// Trimmed entries are not added again, so the timeline is unchanged.
+	os.Remove(file)
+	err = d.profile.updateSubscription(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.entries) != maxSubscriptionEntries {
+		t.Errorf("expected %d entries, got %d", maxSubscriptionEntries, len(s.entries))
+	} else if _, ok := s.entries[timelineKey{u, "gemini://" + address + "/entry0.gmi"}]; ok {
+		t.Error("trimmed entry was added again")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("expected unchanged timeline not to be saved")
+	}
+}
+
+func TestSubscriptionSharedEntries(t *testing.T) {
+	address := testGeminiServer(t, func(w io.Writer, request string) {
+		io.WriteString(w, "20 text/gemini\r\n# Gemlog\n=> gemini://example.org/shared.gmi 2021-01-01 Shared\n")
+	})
+	d := NewDaemon(nil)
+
+	a, b := "gemini://"+address+"/a/", "gemini://"+address+"/b/"
+	for _, u := range []string{a, b} {
+		d.AddSubscription(u, "")
+		err := d.profile.updateSubscription(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := d.profile.subscriptions
+	if len(s.entries) != 2 {
+		t.Fatalf("expected an entry for each subscription, got %d", len(s.entries))
+	}
+	d.RemoveSubscription(a)
+	entry, ok := s.entries[timelineKey{b, "gemini://example.org/shared.gmi"}]
+	if len(s.entries) != 1 || !ok || entry.Subscription != b {
+		t.Errorf("expected entry of other subscription to be kept, got %+v", s.entries)
+	}
+}
+
+func TestAddSubscriptionURL(t *testing.T) {
+	d := NewDaemon(nil)
+	for _, u := range []string{"https://example.org/", "file:///etc/passwd", "gemini:///path", "gemini://%zz/"} {
+		d.AddSubscription(u, "")
+	}
+	d.AddSubscription("Example.org/gemlog/", "")
+
+	subscriptions := d.GetSubscriptions()
+	if _, ok := subscriptions["gemini://example.org/gemlog/"]; len(subscriptions) != 1 || !ok {
+		t.Errorf("expected only Gemini subscription to be added, got %v", subscriptions)
+	}
+}
+
+func TestPollingRestart(t *testing.T) {
+	d := NewDaemon(&DaemonOptions{Subscriptions: true})
+
+	for i := 0; i < 2; i++ {
+		d.startPolling()
+		if !d.isPolling() {
+			t.Fatalf("expected polling to be started (%d)", i)
+		}
+		err := d.Shutdown(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		} else if d.isPolling() {
+			t.Fatalf("expected polling to be stopped (%d)", i)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package gmitohtml
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pageData is the data of a page generated by the daemon.
+type pageData struct {
+	AddressBar    bool
+	NavigationBar bool
+	Bookmarks     bool
+	Subscriptions bool
+	History       bool
+
+	User    string
+	Admin   bool
+	SignOut bool
+
+	CurrentURL string
+	Autofocus  bool
+	Token      string
+	Notice     string
+
+	Lang string
+	Dir  string
+
+	Highlight bool
+
+	MediaToggle *formButton
+
+	Metadata  *Metadata
+	Canonical template.URL
+
+	Content interface{}
+
+	daemon *Daemon
+}
+
+// Link returns the URL of a link served by the daemon.
+func (p *pageData) Link(u string) string {
+	fakeURL, _ := url.Parse("/") // Always succeeds
+	return p.daemon.rewriteURL(u, fakeURL)
+}
+
+// Path returns a path on the daemon, below the path it is served at.
+func (p *pageData) Path(s string) string {
+	return p.daemon.pagePath(s)
+}
+
+// Standalone returns whether the page is converted without a daemon.
+func (p *pageData) Standalone() bool {
+	return p.daemon == nil
+}
+
+// HighlightCSS returns the stylesheet of syntax highlighted preformatted
+// text.
+func (p *pageData) HighlightCSS() template.CSS {
+	return template.CSS(HighlightCSS())
+}
+
+// navigationLink is a link shown in the navigation bar.
+type navigationLink struct {
+	URL   string
+	Label string
+}
+
+// NavigationLinks returns the links shown in the navigation bar, which link
+// to the enabled features.
+func (p *pageData) NavigationLinks() []*navigationLink {
+	var links []*navigationLink
+	if p.Bookmarks {
+		links = append(links,
+			&navigationLink{URL: p.Path("/bookmarks"), Label: "View bookmarks"},
+			&navigationLink{URL: p.Path("/bookmarks") + "?add=" + url.QueryEscape(p.CurrentURL), Label: "Add bookmark"})
+	}
+	if p.Subscriptions {
+		links = append(links, &navigationLink{URL: p.Path("/subscriptions"), Label: "Subscriptions"})
+	}
+	if p.History {
+		links = append(links, &navigationLink{URL: p.Path("/history"), Label: "History"})
+	}
+	if p.Admin {
+		links = append(links, &navigationLink{URL: p.Path("/admin"), Label: "Users"})
+	}
+	if p.SignOut {
+		links = append(links, &navigationLink{URL: p.Path("/logout"), Label: "Sign out (" + p.User + ")"})
+	}
+	return links
+}
+
+// formButton is a form submitting hidden fields via POST.
+type formButton struct {
+	Action string
+	Label  string
+	Token  string
+	Fields []formField
+}
+
+type formField struct {
+	Name  string
+	Value string
+}
+
+// newFormButton returns a form submitting the specified name and value
+// pairs via POST.
+func newFormButton(token string, action string, label string, fields ...string) *formButton {
+	b := &formButton{
+		Action: action,
+		Label:  label,
+		Token:  token,
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.Fields = append(b.Fields, formField{Name: fields[i], Value: fields[i+1]})
+	}
+	return b
+}
+
+var templateFuncs = template.FuncMap{
+	"button": newFormButton,
+	"join":   strings.Join,
+}
+
+// layoutTemplate is the layout of all pages. The header and footer are also
+// executed separately when converted pages are streamed.
+const layoutTemplate = `{{template "header" .}}
+{{template "content" .}}
+{{template "footer" .}}
+{{- define "header"}}<!DOCTYPE html>
+<html{{if .Lang}} lang="{{.Lang}}"{{end}}{{if .Dir}} dir="{{.Dir}}"{{end}}>
+<head>
+<meta name="viewport" content="width=device-width,initial-scale=1">
+{{- with .Metadata}}
+{{- if .Title}}
+<title>{{.Title}}</title>
+<meta property="og:title" content="{{.Title}}">
+{{- end}}
+{{- if .Description}}
+<meta name="description" content="{{.Description}}">
+<meta property="og:description" content="{{.Description}}">
+{{- end}}
+<meta property="og:type" content="article">
+{{- end}}
+{{- if .Canonical}}
+<link rel="canonical" href="{{.Canonical}}">
+<meta property="og:url" content="{{.Canonical}}">
+{{- end}}
+<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/water.css@2/out/water.css">
+{{- if .Highlight}}
+{{- if .Standalone}}
+<style>{{.HighlightCSS}}</style>
+{{- else}}
+<link rel="stylesheet" href="{{$.Path "/assets/highlight.css"}}">
+{{- end}}
+{{- end}}
+</head>
+<body>
+{{- if .AddressBar}}
+<div>
+<form method="post" action="{{$.Path "/"}}" novalidate>
+<input type="url" name="address" id="navigationaddress" placeholder="Address" size="40" value="{{.CurrentURL}}" autocomplete="off" autocorrect="off" autocapitalize="off" spellcheck="false"{{if .Autofocus}} autofocus{{end}}>
+</form>
+</div>
+{{- end}}
+{{- if .NavigationBar}}
+{{- with .NavigationLinks}}
+<nav id="navigationbar">
+{{range $i, $link := .}}{{if $i}} &nbsp;-&nbsp; {{end}}<a href="{{$link.URL}}" class="navlink">{{$link.Label}}</a>{{end}}
+</nav>
+{{- end}}
+{{- with .MediaToggle}}
+<div id="mediatoggle">{{template "button" .}}</div>
+{{- end}}
+{{- end}}
+{{- if .Notice}}
+<p id="notice"><b>{{.Notice}}</b></p>
+{{- end}}
+<main id="content">{{end}}
+{{- define "footer"}}</main>
+</body>
+</html>
+{{end}}
+{{- define "token"}}<input type="hidden" name="` + csrfField + `" value="{{.}}">{{end}}
+{{- define "button"}}<form method="post" action="{{.Action}}">{{template "token" .Token}}{{range .Fields}}<input type="hidden" name="{{.Name}}" value="{{.Value}}">{{end}}<button type="submit">{{.Label}}</button></form>{{end}}`
+
+// newPageTemplate returns a template of a page with the specified content.
+func newPageTemplate(name string, content string) *template.Template {
+	t := template.Must(template.New(name).Funcs(templateFuncs).Parse(layoutTemplate))
+	return template.Must(t.Parse(`{{define "content"}}` + content + `{{end}}`))
+}
+
+var convertedPageTemplate = newPageTemplate("converted", `{{.Content}}`)
+
+var indexTemplate = newPageTemplate("index", `{{with .Content}}<ul>{{range .}}<li><a href="{{$.Link .URL}}">{{.Label}}</a></li>{{end}}</ul>{{end}}`)
+
+var inputPromptTemplate = newPageTemplate("input", `{{with .Content}}
+<form method="post" action="{{.Action}}">
+{{template "token" $.Token}}
+<br>
+<h3>{{.Prompt}}</h3>
+<div>
+<input type="{{.InputType}}" name="input" placeholder="Input" size="40" autocomplete="off" autocorrect="off" autocapitalize="off" spellcheck="false" autofocus>
+</div>
+</form>
+{{end}}`)
+
+var unexpectedHeaderTemplate = newPageTemplate("unexpectedheader", `Server sent unexpected header:<br><br><b>{{.Content}}</b>`)
+
+var accessDeniedTemplate = newPageTemplate("accessdenied", `{{with .Content}}<h3>Access denied</h3>This daemon is not allowed to connect to {{.URL}}<br><br>{{.Error}}{{end}}`)
+
+var certificateChangedTemplate = newPageTemplate("certificatechanged", `{{with .Content}}<h3>Certificate changed</h3>The server hosting {{.URL}} presented a certificate other than the one trusted when it was first visited. This happens when the certificate was replaced, but may also mean the connection is being intercepted.<br><br>{{.Error}}<br><br>{{template "button" (button $.Token ($.Path "/knownhosts") "Trust new certificate" "url" .URL)}}{{end}}`)
+
+var bookmarksTemplate = newPageTemplate("bookmarks", `{{with .Content -}}
+<form method="post" action="{{$.Path "/bookmarks"}}">{{template "token" $.Token}}<h3>Add bookmark</h3><input type="text" size="40" name="address" placeholder="Address" value="{{.Add}}"{{if not .Add}} autofocus{{end}}><br><br><input type="text" size="40" name="label" placeholder="Label"{{if .Add}} autofocus{{end}}><br><br><input type="text" size="40" name="folder" placeholder="Folder (e.g. Reading/Gemlogs)" value="{{.Folder}}"><br><br><input type="text" size="40" name="tags" placeholder="Tags (comma-separated)"><br><br><input type="submit" value="Add"></form>
+{{- if and .HasBookmarks (not .Add)}}
+{{- if .Tag}}<br><h3>Bookmarks tagged {{.Tag}}</h3><a href="{{$.Path "/bookmarks"}}" class="navlink">All bookmarks</a><br><br>
+{{- else}}<br><h3>Bookmarks</h3>
+{{- if .Breadcrumbs}}<a href="{{$.Path "/bookmarks"}}" class="navlink">Bookmarks</a>{{range .Breadcrumbs}} / <a href="{{$.Path "/bookmarks"}}?folder={{.Path}}" class="navlink">{{.Name}}</a>{{end}}<br><br>{{end}}
+{{- range .Subfolders}}&#128193; <a href="{{$.Path "/bookmarks"}}?folder={{.Path}}" class="navlink">{{.Name}}</a><br>{{end}}
+{{- if .Subfolders}}<br>{{end}}
+{{- end}}
+{{- if .Entries}}<table border="1" cellpadding="5">
+{{- range .Entries}}<tr><td>{{.Label}}<br><a href="{{$.Link .URL}}">{{.URL}}</a></td><td>{{if and $.Content.Tag .Folder}}{{.Folder}} {{end}}{{range .Tags}}<a href="{{$.Path "/bookmarks"}}?tag={{.}}" class="navlink">{{.}}</a> {{end}}</td><td><a href="{{$.Path "/bookmarks"}}?edit={{.URL}}" class="navlink">Edit</a></td><td>{{template "button" (button $.Token ($.Path "/bookmarks") "Up" "move" .URL "direction" "up" "folder" .Folder)}}</td><td>{{template "button" (button $.Token ($.Path "/bookmarks") "Down" "move" .URL "direction" "down" "folder" .Folder)}}</td><td><a href="{{$.Path "/bookmarks"}}?delete={{.URL}}" class="navlink">Delete</a></td></tr>{{end -}}
+</table>{{end}}
+<br><h3>Export bookmarks</h3>
+{{- range $i, $format := .Formats}}{{if $i}} &nbsp;-&nbsp; {{end}}<a href="{{$.Path "/bookmarks"}}?export={{$format.Format}}" class="navlink">{{$format.Name}}</a>{{end}}
+{{- end}}
+{{- if not .Add}}<br><br><form method="post" action="{{$.Path "/bookmarks"}}" enctype="multipart/form-data">{{template "token" $.Token}}<h3>Import bookmarks</h3><input type="file" name="import"><br><br><select name="format">{{range .Formats}}<option value="{{.Format}}">{{.Name}}</option>{{end}}</select><br><br><input type="submit" value="Import"></form>{{end}}
+{{- end}}`)
+
+var editBookmarkTemplate = newPageTemplate("editbookmark", `{{with .Content}}<form method="post" action="{{$.Path "/bookmarks"}}">{{template "token" $.Token}}<input type="hidden" name="edit" value="{{.URL}}"><h3>Edit bookmark</h3><input type="text" size="40" name="address" placeholder="Address" value="{{.URL}}" autofocus><br><br><input type="text" size="40" name="label" placeholder="Label" value="{{.Label}}"><br><br><input type="text" size="40" name="folder" placeholder="Folder (e.g. Reading/Gemlogs)" value="{{.Folder}}"><br><br><input type="text" size="40" name="tags" placeholder="Tags (comma-separated)" value="{{join .Tags ", "}}"><br><br><input type="submit" value="Update"></form>{{end}}`)
+
+var deleteBookmarkTemplate = newPageTemplate("deletebookmark", `{{with .Content}}<h3>Delete bookmark</h3>Are you sure you want to delete this bookmark?<br><br>{{.Label}}<br><a href="{{$.Link .URL}}">{{.URL}}</a><br><br>{{template "button" (button $.Token ($.Path "/bookmarks") "Delete" "delete" .URL "folder" .Folder)}}<br><a href="{{$.Path "/bookmarks"}}?folder={{.Folder}}" class="navlink">Cancel</a>{{end}}`)
+
+var historyTemplate = newPageTemplate("history", `{{with .Content -}}
+<form method="get" action="{{$.Path "/history"}}"><h3>History</h3><input type="search" size="40" name="search" placeholder="Search" value="{{.Search}}" autofocus> <input type="submit" value="Search"></form><br>
+{{- if not .Enabled}}History is disabled.<br><br>{{end}}
+{{- if .Days}}
+{{- range .Days}}<h4>{{.Date}}</h4><table border="1" cellpadding="5">{{range .Entries}}<tr><td>{{.Time.Format "15:04"}}</td><td>{{.Title}}<br><a href="{{$.Link .URL}}">{{.URL}}</a></td><td>{{template "button" (button $.Token ($.Path "/history") "Delete" "delete" .URL "search" $.Content.Search)}}</td></tr>{{end}}</table>{{end}}<br><a href="{{$.Path "/history"}}?clear=1" class="navlink">Clear all history</a>
+{{- else if .HasEntries}}No matching history entries.{{end}}
+{{- end}}`)
+
+var clearHistoryTemplate = newPageTemplate("clearhistory", `<h3>Clear history</h3>Are you sure you want to clear all history?<br><br>{{template "button" (button .Token ($.Path "/history") "Clear all history" "clear" "1")}}<br><a href="{{$.Path "/history"}}" class="navlink">Cancel</a>`)
+
+var subscriptionsTemplate = newPageTemplate("subscriptions", `{{with .Content -}}
+<form method="post" action="{{$.Path "/subscriptions"}}">{{template "token" $.Token}}<h3>Subscribe</h3><input type="text" size="40" name="address" placeholder="Address of Gemini page or Atom feed" autofocus><br><br><input type="text" size="40" name="label" placeholder="Label (optional)"><br><br><input type="submit" value="Subscribe"></form>
+{{- if .Timeline}}<br><h3>Timeline</h3>{{range .Timeline}}<h4>{{.Date}}</h4>{{range .Entries}}<a href="{{$.Link .URL}}">{{.Title}}</a> - {{.FeedTitle}}<br>{{end}}{{end}}{{end}}
+{{- if .Subscriptions}}<br><h3>Subscriptions</h3><table border="1" cellpadding="5">{{range .Subscriptions}}<tr><td>{{.Label}}<br><a href="{{$.Link .URL}}">{{.URL}}</a></td><td><a href="{{$.Path "/subscriptions"}}?delete={{.URL}}" class="navlink">Unsubscribe</a></td></tr>{{end}}</table>{{end}}
+{{- end}}`)
+
+var unsubscribeTemplate = newPageTemplate("unsubscribe", `{{with .Content}}<h3>Unsubscribe</h3>Are you sure you want to unsubscribe?<br><br>{{.Label}}<br><a href="{{$.Link .URL}}">{{.URL}}</a><br><br>{{template "button" (button $.Token ($.Path "/subscriptions") "Unsubscribe" "delete" .URL)}}<br><a href="{{$.Path "/subscriptions"}}" class="navlink">Cancel</a>{{end}}`)
+
+var loginTemplate = newPageTemplate("login", `{{with .Content}}<form method="post" action="{{$.Path "/login"}}">{{template "token" $.Token}}<input type="hidden" name="next" value="{{.Next}}"><h3>Sign in</h3>{{if .Limited}}Too many failed sign in attempts. Try again later.<br><br>{{else if .Failed}}Invalid user name or password.<br><br>{{end}}<input type="text" size="40" name="name" placeholder="User name" value="{{.Name}}" autocomplete="username" autocapitalize="off" spellcheck="false"{{if not .Name}} autofocus{{end}}><br><br><input type="password" size="40" name="password" placeholder="Password" autocomplete="current-password"{{if .Name}} autofocus{{end}}><br><br><input type="submit" value="Sign in"></form>{{end}}`)
+
+var logoutTemplate = newPageTemplate("logout", `<h3>Sign out</h3>{{template "button" (button .Token ($.Path "/logout") "Sign out")}}`)
+
+var adminTemplate = newPageTemplate("admin", `{{with .Content -}}
+<h3>Users</h3>
+{{- if .Users}}<table border="1" cellpadding="5">{{range .Users}}<tr><td>{{.Name}}{{if .Admin}} (administrator){{end}}</td><td>{{if $.Content.Passwords}}{{if .Password}}Password set{{else}}No password{{end}}{{end}}</td><td>{{if .Profile}}Profile loaded{{end}}</td><td>{{if ne .Name $.Content.Self}}<a href="{{$.Path "/admin"}}?remove={{.Name}}" class="navlink">Remove</a>{{end}}</td></tr>{{end}}</table>{{else}}No users.{{end}}
+{{- if .Passwords}}<br><form method="post" action="{{$.Path "/admin"}}">{{template "token" $.Token}}<h3>Add user or change password</h3><input type="text" size="40" name="name" placeholder="User name" autocomplete="off" autocapitalize="off" spellcheck="false"><br><br><input type="password" size="40" name="password" placeholder="Password" autocomplete="new-password"><br><br><input type="submit" value="Save"></form>{{end}}
+{{- end}}`)
+
+var removeUserTemplate = newPageTemplate("removeuser", `<h3>Remove user</h3>Are you sure you want to remove {{.Content}}? The bookmarks, client certificates, history and subscriptions of this user are deleted.<br><br>{{template "button" (button .Token ($.Path "/admin") "Remove" "remove" .Content)}}<br><a href="{{$.Path "/admin"}}" class="navlink">Cancel</a>`)
+
+// displayURL returns the URL displayed in the address bar.
+func displayURL(currentURL string) string {
+	if strings.HasPrefix(currentURL, "gemini://") {
+		currentURL = currentURL[9:]
+	}
+	if currentURL == "/" {
+		currentURL = ""
+	}
+	return currentURL
+}
+
+// renderPage returns a page generated by the daemon for the user of a
+// profile. The address bar and navigation bar are only included when d is
+// not nil.
+func (d *Daemon) renderPage(t *template.Template, p *Profile, currentURL string, autofocus bool, token string, content interface{}) []byte {
+	var b bytes.Buffer
+	err := t.Execute(&b, d.newPageData(p, currentURL, autofocus, token, content))
+	if err != nil {
+		log.Printf("failed to render page %s: %s", t.Name(), err)
+	}
+	return b.Bytes()
+}
+
+// newPageData returns the data of a page generated by the daemon.
+func (d *Daemon) newPageData(p *Profile, currentURL string, autofocus bool, token string, content interface{}) *pageData {
+	data := &pageData{
+		CurrentURL: displayURL(currentURL),
+		Autofocus:  autofocus,
+		Token:      token,
+		Content:    content,
+		daemon:     d,
+	}
+	if d != nil {
+		options := d.getOptions()
+		data.AddressBar = options.AddressBar
+		data.NavigationBar = options.NavigationBar
+		data.Bookmarks = options.Bookmarks
+		data.Subscriptions = options.Subscriptions
+		data.History = options.History
+
+		if p != nil && p.name != "" {
+			data.User = p.name
+			data.Admin = options.isAdmin(p.name)
+			data.SignOut = options.Authentication == AuthenticationPassword
+		}
+	}
+	return data
+}
+
+// writePage writes a page generated by the daemon.
+func (d *Daemon) writePage(writer http.ResponseWriter, request *http.Request, t *template.Template, currentURL string, autofocus bool, content interface{}) {
+	token := d.requestToken(d.session(writer, request))
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Write(d.renderPage(t, d.requestProfile(request), currentURL, autofocus, token, content))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/mibzman/gmitohtml/pkg/gmitohtml"
+	"gopkg.in/yaml.v3"
+)
+
+// profileConfig is the configuration of a user profile, which is stored in
+// a separate file when authentication is enabled.
+type profileConfig struct {
+	Bookmarks bookmarkList
+
+	Subscriptions map[string]string
+
+	Certs map[string]*certConfig
+}
+
+// profileDir returns the directory the profile of a user is stored in.
+func profileDir(configPath string, name string) string {
+	return path.Join(path.Dir(configPath), "profiles", name)
+}
+
+// loadProfile loads the profile of a user. History is recorded when enabled
+// in the configuration file.
+func loadProfile(configPath string, p *gmitohtml.Profile) error {
+	if configPath == "" {
+		return nil
+	}
+	dir := profileDir(configPath, p.Name())
+
+	pc := &profileConfig{}
+	data, err := ioutil.ReadFile(path.Join(dir, "config.yaml"))
+	// New profiles have no configuration file and keep the default bookmarks.
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to load profile of %s: %s", p.Name(), err)
+	} else if err == nil {
+		err = yaml.Unmarshal(data, pc)
+		if err != nil {
+			return fmt.Errorf("failed to load profile of %s: %s", p.Name(), err)
+		}
+	}
+
+	configLock.Lock()
+	history, historyLimit := config.History, config.HistoryLimit
+	configLock.Unlock()
+
+	bookmarks := pc.Bookmarks
+	if bookmarks == nil {
+		bookmarks = getBookmarks(p)
+	}
+
+	startApplying(p.Name())
+	err = applyProfile(p, pc.Certs, pc.Bookmarks, pc.Subscriptions, path.Join(dir, "timeline.json"), path.Join(dir, "knownhosts.json"), history, path.Join(dir, "history.json"), historyLimit)
+	if finishApplying(p.Name()) && !profileMatches(p, bookmarks, pc.Subscriptions) {
+		saveErr := saveProfile(configPath, p)
+		if err == nil {
+			err = saveErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load profile of %s: %s", p.Name(), err)
+	}
+	return nil
+}
+
+// saveProfile saves the bookmarks and subscriptions of a user.
+func saveProfile(configPath string, p *gmitohtml.Profile) error {
+	if configPath == "" {
+		return nil
+	}
+	dir := profileDir(configPath, p.Name())
+	file := path.Join(dir, "config.yaml")
+
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if deferSave(p.Name()) {
+		return nil
+	}
+
+	pc := &profileConfig{}
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		yaml.Unmarshal(data, pc) // Certificates are kept when valid
+	}
+	pc.Bookmarks = getBookmarks(p)
+	pc.Subscriptions = p.GetSubscriptions()
+
+	out, err := yaml.Marshal(pc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal profile of %s: %s", p.Name(), err)
+	}
+
+	os.MkdirAll(dir, 0700) // Ignore error
+
+	err = ioutil.WriteFile(file, out, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save profile of %s to %s: %s", p.Name(), file, err)
+	}
+	return nil
+}
+
+// setupProfiles loads the profile of each user when it is created, saves it
+// when it is changed, and deletes it when it is removed.
+func setupProfiles(configPath string, d *gmitohtml.Daemon) {
+	d.SetOnProfileCreated(func(p *gmitohtml.Profile) {
+		err := loadProfile(configPath, p)
+		if err != nil {
+			log.Print(err)
+		}
+
+		save := func() {
+			err := saveProfile(configPath, p)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+		p.SetOnBookmarksChanged(save)
+		p.SetOnSubscriptionsChanged(save)
+	})
+
+	d.SetOnProfileRemoved(func(p *gmitohtml.Profile) {
+		if configPath == "" {
+			return
+		}
+		err := os.RemoveAll(profileDir(configPath, p.Name()))
+		if err != nil {
+			log.Printf("failed to remove profile of %s: %s", p.Name(), err)
+		}
+	})
+}
+
+// loadProfiles loads the profiles of all users stored previously, so their
+// subscriptions are updated and they may be managed by administrators.
+func loadProfiles(configPath string, d *gmitohtml.Daemon) {
+	if configPath == "" {
+		return
+	}
+	entries, err := ioutil.ReadDir(path.Join(path.Dir(configPath), "profiles"))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			d.Profile(entry.Name())
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is the maximum time to wait for active requests to
+// complete when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// configWatchInterval is the time between checks for configuration changes.
+const configWatchInterval = 2 * time.Second
+
+// handleSignals calls reload on SIGHUP, and calls shutdown and returns on
+// SIGINT or SIGTERM.
+func handleSignals(reload func(), shutdown func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reload()
+			continue
+		}
+
+		shutdown()
+		return
+	}
+}
+
+// watchConfigFile calls reload when the configuration file is modified.
+// Changes made by gmitohtml itself are ignored.
+func watchConfigFile(configPath string, reload func()) {
+	t := time.NewTicker(configWatchInterval)
+	defer t.Stop()
+
+	for range t.C {
+		if configModified(configPath) {
+			reload()
+		}
+	}
+}